@@ -7,7 +7,6 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gosexy/to v0.0.0-20141221203644-c20e083e3123
 	github.com/julienschmidt/httprouter v1.2.0 // indirect
-	github.com/kr/s3 v0.0.0-20141124221453-c070c8f9a8f0
 	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/pkg/errors v0.8.1
 	github.com/twinj/uuid v1.0.0 // indirect
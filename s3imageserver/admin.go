@@ -0,0 +1,90 @@
+package s3imageserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type purgeResult struct {
+	Removed int `json:"removed"`
+}
+
+// Handles DELETE /admin/cache?path=/bucket/key and DELETE /admin/cache?prefix=/bucket/folder/, removing the matching
+// source images and derivatives from every cache tier
+func purgeHandler(adminToken string, caches []PurgeableCache, sourceMemory *memoryCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, adminToken) {
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path, prefix := r.URL.Query().Get("path"), false
+		if path == "" {
+			path, prefix = r.URL.Query().Get("prefix"), true
+		}
+		if path == "" {
+			http.Error(w, "path or prefix is required", http.StatusBadRequest)
+			return
+		}
+
+		result := purgeResult{}
+		if sourceMemory != nil {
+			result.Removed += sourceMemory.purge("", path, prefix)
+		}
+		for _, cache := range caches {
+			removed, err := cache.Purge(path, prefix)
+			result.Removed += removed
+			if err != nil {
+				log.Printf("Error purging %v from cache %+v", path, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		log.Println("Purged", result.Removed, "cache entries for", path, "prefix:", prefix)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("Error writing result %+v", err)
+		}
+	}
+}
+
+// Handles GET /admin/stats, the hit and miss counters of the memory caches
+func statsHandler(adminToken string, memory, sourceMemory *memoryCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, adminToken) {
+			return
+		}
+		stats := map[string]CacheStats{}
+		if memory != nil {
+			stats["derivatives"] = memory.Stats()
+		}
+		if sourceMemory != nil {
+			stats["sources"] = sourceMemory.Stats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("Error writing stats %+v", err)
+		}
+	}
+}
+
+// Checks the admin token sent as Authorization: Bearer, responding with 401 or 403 when it is missing or wrong
+func adminAuthorized(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	token := bearerToken(r)
+	if token == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package s3imageserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/RetroRabbit/vips"
+)
+
+// A rendered image together with what is needed to answer for it without rendering again
+type CachedImage struct {
+	Data         []byte
+	Format       vips.ImageType
+	ETag         string
+	LastModified time.Time
+}
+
+// A store for rendered images, keyed by the source path and a variant describing the formatting settings
+type DerivativeCache interface {
+	Get(path, variant string) (*CachedImage, bool)
+	Set(path, variant string, img *CachedImage) error
+}
+
+// Optionally implemented by caches that can remove entries, returns how many were removed
+type PurgeableCache interface {
+	Purge(path string, prefix bool) (int, error)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Builds the configured cache for a route, routes get their own directory under cache_path
+func newRouteCache(config HandlerConfig) DerivativeCache {
+	if config.Cache != nil {
+		return config.Cache
+	}
+	if !config.CacheEnabled {
+		return nil
+	}
+	cachePath := config.CachePath
+	if cachePath == "" {
+		cachePath = defaultCachePath
+	}
+	ttl := time.Duration(defaultCacheMaxAge) * time.Second
+	if config.CacheTime != nil {
+		ttl = time.Duration(*config.CacheTime) * time.Second
+	}
+	routeDir := strings.Trim(strings.Replace(config.Route, "/", "_", -1), "_")
+	if routeDir == "" {
+		routeDir = "root"
+	}
+	cache, err := NewDiskCache(filepath.Join(cachePath, routeDir), ttl, config.CacheMaxBytes)
+	if err != nil {
+		log.Println("Cannot enable cache for route", config.Route, "due to", err)
+		return nil
+	}
+	return cache
+}
@@ -0,0 +1,153 @@
+package s3imageserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Chains may contain chains, up to this depth
+const maxChainDepth = 4
+
+type ChainConfig struct {
+	Sources []ChainEntry `json:"sources"`
+	// try the next source on any error, not only when the image is not found
+	FallbackOnError bool `json:"fallback_on_error"`
+}
+
+type ChainEntry struct {
+	// a registered source type
+	Source string `json:"source"`
+	// the configuration of the source, defaults to its entry in sources
+	Config  json.RawMessage `json:"config"`
+	Rewrite *RegexRewrite   `json:"rewrite"`
+}
+
+type chainLink struct {
+	name    string
+	source  ImageSource
+	match   *regexp.Regexp
+	replace string
+}
+
+type chainSource struct {
+	ChainConfig
+	links []chainLink
+}
+
+// Implemented by sources built from other configured sources, which Run resolves once all configs are known
+type compositeSource interface {
+	resolveSources(configs map[string]json.RawMessage, depth int) error
+}
+
+// A source trying other sources in order until one has the image
+func NewChainSource(config ChainConfig) *chainSource {
+	return &chainSource{ChainConfig: config}
+}
+
+func (s *chainSource) resolveSources(configs map[string]json.RawMessage, depth int) error {
+	if depth > maxChainDepth {
+		return errors.New("chain sources are nested too deeply")
+	}
+	s.links = nil
+	for _, entry := range s.Sources {
+		config := entry.Config
+		if config == nil {
+			config = configs[entry.Source]
+		}
+		if config == nil {
+			config = json.RawMessage("{}")
+		}
+		source, err := Sources.GetSource(entry.Source, config)
+		if err != nil {
+			return errors.Wrapf(err, "Could not create chained source %v", entry.Source)
+		}
+		if cs, ok := source.(compositeSource); ok {
+			if err := cs.resolveSources(configs, depth+1); err != nil {
+				return err
+			}
+		}
+		link := chainLink{name: entry.Source, source: source}
+		if entry.Rewrite != nil {
+			if link.match, err = regexp.Compile(entry.Rewrite.Match); err != nil {
+				return errors.Wrapf(err, "Invalid rewrite for chained source %v", entry.Source)
+			}
+			link.replace = entry.Rewrite.Replace
+		}
+		s.links = append(s.links, link)
+	}
+	if len(s.links) == 0 {
+		return errors.New("chain has no sources")
+	}
+	return nil
+}
+
+func (l chainLink) path(path string) string {
+	if l.match == nil {
+		return path
+	}
+	return l.match.ReplaceAllString(path, l.replace)
+}
+
+// Whether the next source should be tried after err
+func (s *chainSource) fallThrough(err error) bool {
+	return s.FallbackOnError || IsNotFound(err)
+}
+
+func (s *chainSource) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *chainSource) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return readStream(s.OpenImage(context.Background(), path))
+}
+
+func (s *chainSource) OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error) {
+	err := errors.Wrapf(ErrNotFound, "chain has no sources for %v", path)
+	for _, link := range s.links {
+		var body io.ReadCloser
+		var meta *ImageMetadata
+		body, meta, err = openImage(ctx, link.source, link.path(path))
+		if err == nil {
+			return body, meta, nil
+		}
+		if !s.fallThrough(err) {
+			return nil, nil, errors.Wrapf(err, "Chained source %v failed", link.name)
+		}
+	}
+	return nil, nil, err
+}
+
+func (s *chainSource) UsesPreviewOptions() bool {
+	for _, link := range s.links {
+		if usesPreviewOptions(link.source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks the metadata up in the first source that has the image. Sources that cannot look up metadata cannot tell
+// whether they have it, so the lookup stops there.
+func (s *chainSource) GetMetadata(path string) (*ImageMetadata, error) {
+	err := errors.Wrapf(ErrNotFound, "chain has no sources for %v", path)
+	for _, link := range s.links {
+		ms, ok := link.source.(MetadataSource)
+		if !ok {
+			return nil, errMetadataUnsupported
+		}
+		var meta *ImageMetadata
+		meta, err = ms.GetMetadata(link.path(path))
+		if err == nil {
+			return meta, nil
+		}
+		if !s.fallThrough(err) {
+			return nil, errors.Wrapf(err, "Chained source %v failed", link.name)
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,133 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A string that changes whenever anything affecting the rendered output changes
+func (fs *FormatSettings) canonical() string {
+	query := settingsQuery(*fs)
+	query.Set("w", strconv.Itoa(fs.Width))
+	query.Set("h", strconv.Itoa(fs.Height))
+	query.Set("wm", strconv.FormatBool(fs.WidthMissing))
+	query.Set("hm", strconv.FormatBool(fs.HeightMissing))
+	query.Set("f", strconv.Itoa(int(fs.OutputFormat)))
+	return query.Encode()
+}
+
+// Fetches the image, along with its metadata when the source supports it. Streaming sources are cancelled with ctx.
+func getImageWithMetadata(ctx context.Context, source ImageSource, path string) ([]byte, *ImageMetadata, error) {
+	if ss, ok := source.(StreamingImageSource); ok {
+		return readStream(ss.OpenImage(ctx, path))
+	}
+	if ms, ok := source.(MetadataImageSource); ok {
+		img, meta, err := ms.GetImageWithMetadata(path)
+		if meta == nil {
+			meta = &ImageMetadata{}
+		}
+		return img, meta, err
+	}
+	img, err := source.GetImage(path)
+	return img, &ImageMetadata{}, err
+}
+
+// Opens the image as a stream, buffering it for sources that only implement ImageSource
+func openImage(ctx context.Context, source ImageSource, path string) (io.ReadCloser, *ImageMetadata, error) {
+	if ss, ok := source.(StreamingImageSource); ok {
+		body, meta, err := ss.OpenImage(ctx, path)
+		if err == nil && meta == nil {
+			meta = &ImageMetadata{}
+		}
+		return body, meta, err
+	}
+	img, meta, err := getImageWithMetadata(ctx, source, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Size == 0 {
+		meta.Size = int64(len(img))
+	}
+	return ioutil.NopCloser(bytes.NewReader(img)), meta, nil
+}
+
+// Reads and closes a stream, lets streaming sources implement ImageSource with their OpenImage
+func readStream(body io.ReadCloser, meta *ImageMetadata, err error) ([]byte, *ImageMetadata, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, nil, upstreamError(err, "Error reading image")
+	}
+	if meta == nil {
+		meta = &ImageMetadata{}
+	}
+	return data, meta, nil
+}
+
+// A strong ETag for the derivative, built from the source ETag or, failing that, a hash of the source bytes
+func derivativeETag(meta *ImageMetadata, img []byte, settings *FormatSettings) string {
+	sourceTag := meta.ETag
+	if sourceTag == "" {
+		if img == nil {
+			return ""
+		}
+		sum := sha256.Sum256(img)
+		sourceTag = hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(sourceTag + "|" + settings.canonical()))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func hasConditionalHeaders(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// Evaluates If-None-Match and, only when that is absent, If-Modified-Since
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+func setValidatorHeaders(w http.ResponseWriter, etag string, lastModified time.Time) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+func writeNotModified(w http.ResponseWriter, caching cachePolicy, etag string, lastModified time.Time, vary ...string) {
+	caching.setHeaders(w, time.Now(), vary...)
+	setValidatorHeaders(w, etag, lastModified)
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,400 @@
+package s3imageserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// temporary credentials are replaced this long before they expire
+	credentialRefreshWindow = 5 * time.Minute
+	// how long a failed lookup is reused before the providers are asked again
+	credentialRetryInterval = 30 * time.Second
+	defaultEC2Endpoint      = "http://169.254.169.254"
+	defaultECSEndpoint      = "http://169.254.170.2"
+	defaultSTSEndpoint      = "https://sts.amazonaws.com"
+)
+
+// A source of AWS credentials, a zero expiry means the credentials do not expire
+type credentialProvider interface {
+	retrieve() (awsCredentials, time.Time, error)
+}
+
+// Tries each provider in order and caches the first credentials found until shortly before they expire
+type credentialChain struct {
+	providers   []credentialProvider
+	refreshes   flightGroup
+	mu          sync.Mutex
+	creds       *awsCredentials
+	expires     time.Time
+	err         error
+	failedUntil time.Time
+	// a refresh is running in the background while the current credentials are still used
+	refreshing bool
+}
+
+// The chain used by S3 sources: keys from the config, the environment, the shared credentials file, a web identity
+// token file, then the ECS and EC2 metadata endpoints
+func newCredentialChain(c S3Config) *credentialChain {
+	client := &http.Client{Timeout: 5 * time.Second}
+	metadataClient := &http.Client{Timeout: time.Second}
+	var providers []credentialProvider
+	if c.AWSAccess != "" && c.AWSSecret != "" {
+		providers = append(providers, &staticProvider{awsCredentials{AccessKey: c.AWSAccess, SecretKey: c.AWSSecret}})
+	}
+	providers = append(providers,
+		&envProvider{},
+		&sharedFileProvider{profile: c.Profile},
+		&webIdentityProvider{stsEndpoint: os.Getenv("AWS_ENDPOINT_URL_STS"), client: client},
+		&ecsProvider{endpoint: defaultECSEndpoint, client: metadataClient},
+		&ec2Provider{endpoint: os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), client: metadataClient},
+	)
+	return &credentialChain{providers: providers}
+}
+
+func (c *credentialChain) get() (awsCredentials, error) {
+	c.mu.Lock()
+	now := time.Now()
+	fresh := c.creds != nil && (c.expires.IsZero() || now.Add(credentialRefreshWindow).Before(c.expires))
+	retry := !now.Before(c.failedUntil)
+	c.mu.Unlock()
+	if !fresh && retry {
+		//one refresh at a time, without holding the lock over its round trips. Requests carry on with credentials
+		//that are about to expire rather than waiting for it.
+		if creds, ok := c.current(); ok {
+			c.mu.Lock()
+			start := !c.refreshing
+			c.refreshing = true
+			c.mu.Unlock()
+			if start {
+				go func() {
+					c.refreshes.do("", c.refresh)
+					c.mu.Lock()
+					c.refreshing = false
+					c.mu.Unlock()
+				}()
+			}
+			return creds, nil
+		}
+		c.refreshes.do("", c.refresh)
+	}
+
+	if creds, ok := c.current(); ok {
+		return creds, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return awsCredentials{}, c.err
+}
+
+// The cached credentials, as long as they have not expired
+func (c *credentialChain) current() (awsCredentials, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds != nil && (c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return *c.creds, true
+	}
+	return awsCredentials{}, false
+}
+
+// Asks the providers in order, a failure is remembered so requests do not all go through the chain again
+func (c *credentialChain) refresh() (interface{}, error) {
+	var errs []string
+	for _, provider := range c.providers {
+		creds, expires, err := provider.retrieve()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		c.mu.Lock()
+		c.creds, c.expires, c.err, c.failedUntil = &creds, expires, nil, time.Time{}
+		c.mu.Unlock()
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds != nil && time.Now().Before(c.expires) {
+		log.Println("Refreshing AWS credentials failed, using the current ones until they expire:", strings.Join(errs, "; "))
+	}
+	c.err = errors.Errorf("no AWS credentials found: %v", strings.Join(errs, "; "))
+	c.failedUntil = time.Now().Add(credentialRetryInterval)
+	return nil, c.err
+}
+
+type staticProvider struct {
+	creds awsCredentials
+}
+
+func (p *staticProvider) retrieve() (awsCredentials, time.Time, error) {
+	return p.creds, time.Time{}, nil
+}
+
+type envProvider struct{}
+
+func (p *envProvider) retrieve() (awsCredentials, time.Time, error) {
+	creds := awsCredentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" {
+		creds.AccessKey = os.Getenv("AWS_ACCESS_KEY")
+	}
+	if creds.SecretKey == "" {
+		creds.SecretKey = os.Getenv("AWS_SECRET_KEY")
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return awsCredentials{}, time.Time{}, errors.New("environment: AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return creds, time.Time{}, nil
+}
+
+// Reads the ini style credentials file, AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials by default
+type sharedFileProvider struct {
+	path    string
+	profile string
+}
+
+func (p *sharedFileProvider) retrieve() (awsCredentials, time.Time, error) {
+	path := p.path
+	if path == "" {
+		path = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, time.Time{}, errors.Wrap(err, "shared credentials file")
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := p.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "shared credentials file")
+	}
+	defer f.Close()
+
+	creds := awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.AccessKey = value
+		case "aws_secret_access_key":
+			creds.SecretKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "shared credentials file")
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return awsCredentials{}, time.Time{}, errors.Errorf("shared credentials file: no keys for profile %v in %v", profile, path)
+	}
+	return creds, time.Time{}, nil
+}
+
+// Exchanges the token in AWS_WEB_IDENTITY_TOKEN_FILE for temporary credentials of AWS_ROLE_ARN, as used by EKS
+type webIdentityProvider struct {
+	stsEndpoint string
+	client      *http.Client
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+func (p *webIdentityProvider) retrieve() (awsCredentials, time.Time, error) {
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return awsCredentials{}, time.Time{}, errors.New("web identity: AWS_WEB_IDENTITY_TOKEN_FILE or AWS_ROLE_ARN not set")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "web identity")
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "s3imageserver"
+	}
+	endpoint := p.stsEndpoint
+	if endpoint == "" {
+		endpoint = defaultSTSEndpoint
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	resp, err := p.client.PostForm(endpoint, form)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "web identity")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, time.Time{}, errors.Errorf("web identity: %v from STS", resp.StatusCode)
+	}
+	var result assumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "web identity")
+	}
+	c := result.Credentials
+	return awsCredentials{AccessKey: c.AccessKeyID, SecretKey: c.SecretAccessKey, SessionToken: c.SessionToken}, c.Expiration, nil
+}
+
+// The JSON document both the ECS and the EC2 metadata endpoints return
+type metadataCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func getMetadataCredentials(client *http.Client, req *http.Request, name string) (awsCredentials, time.Time, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, time.Time{}, errors.Errorf("%v: %v from metadata endpoint", name, resp.StatusCode)
+	}
+	var c metadataCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, name)
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, time.Time{}, errors.Errorf("%v: metadata endpoint returned no keys", name)
+	}
+	return awsCredentials{AccessKey: c.AccessKeyID, SecretKey: c.SecretAccessKey, SessionToken: c.Token}, c.Expiration, nil
+}
+
+// The ECS task role, found through AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI
+type ecsProvider struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (p *ecsProvider) retrieve() (awsCredentials, time.Time, error) {
+	credsURL := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		credsURL = p.endpoint + relative
+	}
+	if credsURL == "" {
+		return awsCredentials{}, time.Time{}, errors.New("ecs: AWS_CONTAINER_CREDENTIALS_RELATIVE_URI not set")
+	}
+	req, err := http.NewRequest("GET", credsURL, nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "ecs")
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return getMetadataCredentials(p.client, req, "ecs")
+}
+
+// The instance profile from the EC2 instance metadata service, using an IMDSv2 session token
+type ec2Provider struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (p *ec2Provider) retrieve() (awsCredentials, time.Time, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return awsCredentials{}, time.Time{}, errors.New("ec2: metadata service disabled")
+	}
+	endpoint := strings.TrimSuffix(p.endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultEC2Endpoint
+	}
+
+	tokenReq, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "ec2")
+	}
+	tokenReq.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := p.get(tokenReq)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+
+	roleReq, err := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "ec2")
+	}
+	roleReq.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	roles, err := p.get(roleReq)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, time.Time{}, errors.New("ec2: no instance profile attached")
+	}
+
+	credsReq, err := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+url.PathEscape(role), nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "ec2")
+	}
+	credsReq.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	return getMetadataCredentials(p.client, credsReq, "ec2")
+}
+
+func (p *ec2Provider) get(req *http.Request) (string, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "ec2")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("ec2: %v from metadata service", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), errors.Wrap(err, "ec2")
+}
@@ -0,0 +1,341 @@
+package s3imageserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sets the environment variables for the duration of a test, an empty value unsets one
+func setEnv(t *testing.T, vars map[string]string) func() {
+	previous := map[string]*string{}
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		var err error
+		if value == "" {
+			err = os.Unsetenv(name)
+		} else {
+			err = os.Setenv(name, value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+const testExpiration = "2030-01-02T03:04:05Z"
+
+func checkCredentials(t *testing.T, name string, creds awsCredentials, expires time.Time, err error, want awsCredentials) {
+	if err != nil {
+		t.Fatalf("%v: %v", name, err)
+	}
+	if creds != want {
+		t.Errorf("%v: got %+v, want %+v", name, creds, want)
+	}
+	if got := expires.UTC().Format(time.RFC3339); got != testExpiration {
+		t.Errorf("%v: expires %v, want %v", name, got, testExpiration)
+	}
+}
+
+func metadataDocument(w http.ResponseWriter) {
+	fmt.Fprintf(w, `{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"session","Expiration":"%v"}`, testExpiration)
+}
+
+func TestEC2Provider(t *testing.T) {
+	defer setEnv(t, map[string]string{"AWS_EC2_METADATA_DISABLED": ""})()
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != "PUT" || r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "imds-token")
+			return
+		}
+		if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "image-role\n")
+		case "/latest/meta-data/iam/security-credentials/image-role":
+			metadataDocument(w)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	provider := &ec2Provider{endpoint: server.URL, client: server.Client()}
+	creds, expires, err := provider.retrieve()
+	checkCredentials(t, "ec2", creds, expires, err, awsCredentials{AccessKey: "AKID", SecretKey: "secret", SessionToken: "session"})
+	want := []string{
+		"PUT /latest/api/token",
+		"GET /latest/meta-data/iam/security-credentials/",
+		"GET /latest/meta-data/iam/security-credentials/image-role",
+	}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("requests %v, want %v", requests, want)
+	}
+
+	defer setEnv(t, map[string]string{"AWS_EC2_METADATA_DISABLED": "true"})()
+	if _, _, err := provider.retrieve(); err == nil {
+		t.Error("the provider should do nothing when the metadata service is disabled")
+	}
+}
+
+func TestECSProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/relative":
+			metadataDocument(w)
+		case "/full":
+			if r.Header.Get("Authorization") != "ecs-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			metadataDocument(w)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	want := awsCredentials{AccessKey: "AKID", SecretKey: "secret", SessionToken: "session"}
+	provider := &ecsProvider{endpoint: server.URL, client: server.Client()}
+
+	restore := setEnv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/relative",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "",
+	})
+	creds, expires, err := provider.retrieve()
+	checkCredentials(t, "relative uri", creds, expires, err, want)
+	restore()
+
+	restore = setEnv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL + "/full",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "ecs-token",
+	})
+	creds, expires, err = provider.retrieve()
+	checkCredentials(t, "full uri", creds, expires, err, want)
+	restore()
+
+	restore = setEnv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL + "/full",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "",
+	})
+	if _, _, err := provider.retrieve(); err == nil {
+		t.Error("full uri without the authorization token should fail")
+	}
+	restore()
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webidentity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("jwt-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(t, map[string]string{
+		"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile,
+		"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/images",
+		"AWS_ROLE_SESSION_NAME":       "",
+	})()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" || r.FormValue("WebIdentityToken") != "jwt-token" ||
+			r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/images" || r.FormValue("RoleSessionName") != "s3imageserver" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>sts-secret</SecretAccessKey>
+      <SessionToken>sts-session</SessionToken>
+      <Expiration>%v</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, testExpiration)
+	}))
+	defer server.Close()
+
+	provider := &webIdentityProvider{stsEndpoint: server.URL, client: server.Client()}
+	creds, expires, err := provider.retrieve()
+	checkCredentials(t, "web identity", creds, expires, err, awsCredentials{AccessKey: "ASIAEXAMPLE", SecretKey: "sts-secret", SessionToken: "sts-session"})
+}
+
+func TestSharedFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharedcredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+	file := `# comment
+[default]
+aws_access_key_id = DEFAULTKEY
+aws_secret_access_key = defaultsecret
+
+[images]
+aws_access_key_id=IMAGESKEY
+aws_secret_access_key=imagessecret
+aws_session_token=imagestoken
+
+[empty]
+`
+	if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		profile    string
+		envProfile string
+		want       awsCredentials
+		ok         bool
+	}{
+		{"", "", awsCredentials{AccessKey: "DEFAULTKEY", SecretKey: "defaultsecret"}, true},
+		{"", "images", awsCredentials{AccessKey: "IMAGESKEY", SecretKey: "imagessecret", SessionToken: "imagestoken"}, true},
+		{"images", "", awsCredentials{AccessKey: "IMAGESKEY", SecretKey: "imagessecret", SessionToken: "imagestoken"}, true},
+		{"default", "images", awsCredentials{AccessKey: "DEFAULTKEY", SecretKey: "defaultsecret"}, true},
+		{"empty", "", awsCredentials{}, false},
+		{"missing", "", awsCredentials{}, false},
+	}
+	for _, test := range tests {
+		restore := setEnv(t, map[string]string{"AWS_PROFILE": test.envProfile})
+		creds, _, err := (&sharedFileProvider{path: path, profile: test.profile}).retrieve()
+		restore()
+		if (err == nil) != test.ok || creds != test.want {
+			t.Errorf("profile %q with AWS_PROFILE %q: got %+v, %v, want %+v", test.profile, test.envProfile, creds, err, test.want)
+		}
+	}
+}
+
+type testProvider struct {
+	mu      sync.Mutex
+	calls   int
+	creds   awsCredentials
+	expires time.Time
+	err     error
+	release chan struct{}
+}
+
+func (p *testProvider) retrieve() (awsCredentials, time.Time, error) {
+	p.mu.Lock()
+	p.calls++
+	release := p.release
+	p.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.creds, p.expires, p.err
+}
+
+func (p *testProvider) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func TestCredentialChainCachesUntilTheRefreshWindow(t *testing.T) {
+	provider := &testProvider{creds: awsCredentials{AccessKey: "first"}, expires: time.Now().Add(time.Hour)}
+	chain := &credentialChain{providers: []credentialProvider{provider}}
+	for i := 0; i < 3; i++ {
+		if creds, err := chain.get(); err != nil || creds.AccessKey != "first" {
+			t.Fatalf("got %+v, %v", creds, err)
+		}
+	}
+	if calls := provider.callCount(); calls != 1 {
+		t.Errorf("provider called %v times, want once", calls)
+	}
+}
+
+func TestCredentialChainRefreshesInTheBackground(t *testing.T) {
+	provider := &testProvider{creds: awsCredentials{AccessKey: "second"}, expires: time.Now().Add(time.Hour), release: make(chan struct{})}
+	current := awsCredentials{AccessKey: "first"}
+	//inside the refresh window, but not expired yet
+	chain := &credentialChain{providers: []credentialProvider{provider}, creds: &current, expires: time.Now().Add(time.Minute)}
+
+	for i := 0; i < 5; i++ {
+		if creds, err := chain.get(); err != nil || creds.AccessKey != "first" {
+			t.Fatalf("while refreshing got %+v, %v, want the current credentials", creds, err)
+		}
+	}
+	close(provider.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		creds, err := chain.get()
+		if err == nil && creds.AccessKey == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("credentials were not refreshed, got %+v, %v", creds, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := provider.callCount(); calls != 1 {
+		t.Errorf("provider called %v times, want one shared refresh", calls)
+	}
+}
+
+func TestCredentialChainBacksOffAfterFailures(t *testing.T) {
+	provider := &testProvider{err: errors.New("metadata service unreachable")}
+	chain := &credentialChain{providers: []credentialProvider{provider}}
+	for i := 0; i < 5; i++ {
+		if _, err := chain.get(); err == nil {
+			t.Fatal("expected an error without credentials")
+		}
+	}
+	if calls := provider.callCount(); calls != 1 {
+		t.Errorf("provider called %v times during the backoff, want once", calls)
+	}
+	chain.mu.Lock()
+	if retry := chain.failedUntil.Sub(time.Now()); retry <= 0 || retry > credentialRetryInterval {
+		t.Errorf("retry in %v, want within %v", retry, credentialRetryInterval)
+	}
+	//once the backoff has passed the providers are asked again
+	chain.failedUntil = time.Now().Add(-time.Second)
+	chain.mu.Unlock()
+	provider.mu.Lock()
+	provider.creds, provider.expires, provider.err = awsCredentials{AccessKey: "recovered"}, time.Time{}, nil
+	provider.mu.Unlock()
+	if creds, err := chain.get(); err != nil || creds.AccessKey != "recovered" {
+		t.Errorf("after the backoff got %+v, %v", creds, err)
+	}
+	if calls := provider.callCount(); calls != 2 {
+		t.Errorf("provider called %v times, want twice", calls)
+	}
+}
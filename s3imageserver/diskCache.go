@@ -0,0 +1,276 @@
+package s3imageserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RetroRabbit/vips"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCachePath       = "./cache"
+	diskCacheSweepInterval = 5 * time.Minute
+	diskCacheTempPrefix    = ".tmp-"
+	diskCachePathFile      = ".path"
+)
+
+// Stored as a JSON line in front of the image data
+type diskCacheHeader struct {
+	Format       vips.ImageType `json:"format"`
+	ETag         string         `json:"etag"`
+	LastModified time.Time      `json:"last_modified"`
+	Created      time.Time      `json:"created"`
+}
+
+// A sharded directory of rendered images. Entries expire after ttl, the modification time of a file records its
+// last use so the sweeper can evict the least recently used entries once maxBytes is exceeded.
+type diskCache struct {
+	root     string
+	ttl      time.Duration
+	maxBytes int64
+}
+
+func NewDiskCache(root string, ttl time.Duration, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Could not create cache directory %v", root)
+	}
+	c := &diskCache{
+		root:     root,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+	}
+	go c.sweepForever()
+	return c, nil
+}
+
+// Entries of a path share a directory, sharded on the first two characters of its hash
+func (c *diskCache) pathDir(path string) string {
+	pathHash := hashKey(path)
+	return filepath.Join(c.root, pathHash[:2], pathHash)
+}
+
+func (c *diskCache) file(path, variant string) string {
+	return filepath.Join(c.pathDir(path), hashKey(variant))
+}
+
+func (c *diskCache) Get(path, variant string) (*CachedImage, bool) {
+	name := c.file(path, variant)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header, err := readDiskCacheHeader(reader)
+	if err != nil {
+		log.Println("Removing unreadable cache entry", name, err)
+		_ = os.Remove(name)
+		return nil, false
+	}
+	if c.expired(header) {
+		_ = os.Remove(name)
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(name, now, now)
+
+	return &CachedImage{
+		Data:         data,
+		Format:       header.Format,
+		ETag:         header.ETag,
+		LastModified: header.LastModified,
+	}, true
+}
+
+// Writes to a temporary file first and renames it into place, so readers never see a partial entry
+func (c *diskCache) Set(path, variant string, img *CachedImage) error {
+	dir := c.pathDir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Could not create cache directory")
+	}
+	header, err := json.Marshal(diskCacheHeader{
+		Format:       img.Format,
+		ETag:         img.ETag,
+		LastModified: img.LastModified,
+		Created:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	//the source path is kept next to its entries so they can be purged by prefix
+	pathFile := filepath.Join(dir, diskCachePathFile)
+	if _, err := os.Stat(pathFile); os.IsNotExist(err) {
+		if err := writeFileAtomic(pathFile, []byte(path)); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(c.file(path, variant), append(header, '\n'), img.Data)
+}
+
+func writeFileAtomic(name string, chunks ...[]byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), diskCacheTempPrefix)
+	if err != nil {
+		return errors.Wrap(err, "Could not create cache file")
+	}
+	for _, chunk := range chunks {
+		if _, err = tmp.Write(chunk); err != nil {
+			break
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "Could not write cache file")
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "Could not move cache file into place")
+	}
+	return nil
+}
+
+// Removes every entry of path, or of every path starting with it when prefix is set
+func (c *diskCache) Purge(path string, prefix bool) (int, error) {
+	if !prefix {
+		return removeDiskCachePath(c.pathDir(path))
+	}
+	shards, err := ioutil.ReadDir(c.root)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		dirs, err := ioutil.ReadDir(filepath.Join(c.root, shard.Name()))
+		if err != nil {
+			continue
+		}
+		for _, dir := range dirs {
+			pathDir := filepath.Join(c.root, shard.Name(), dir.Name())
+			cachedPath, err := ioutil.ReadFile(filepath.Join(pathDir, diskCachePathFile))
+			if err != nil || !strings.HasPrefix(string(cachedPath), path) {
+				continue
+			}
+			n, err := removeDiskCachePath(pathDir)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+func removeDiskCachePath(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if file.Name() != diskCachePathFile && !strings.HasPrefix(file.Name(), diskCacheTempPrefix) {
+			removed++
+		}
+	}
+	return removed, os.RemoveAll(dir)
+}
+
+func (c *diskCache) expired(header *diskCacheHeader) bool {
+	return c.ttl > 0 && time.Since(header.Created) > c.ttl
+}
+
+func readDiskCacheHeader(reader *bufio.Reader) (*diskCacheHeader, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	header := &diskCacheHeader{}
+	err = json.Unmarshal(line, header)
+	return header, err
+}
+
+func (c *diskCache) sweepForever() {
+	for range time.Tick(diskCacheSweepInterval) {
+		c.sweep()
+	}
+}
+
+type diskCacheFile struct {
+	name    string
+	size    int64
+	lastUse time.Time
+}
+
+// Removes expired entries and stale temporary files, then the least recently used entries above maxBytes
+func (c *diskCache) sweep() {
+	var files []diskCacheFile
+	var total int64
+	err := filepath.Walk(c.root, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if info.Name() == diskCachePathFile {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), diskCacheTempPrefix) {
+			if time.Since(info.ModTime()) > time.Hour {
+				_ = os.Remove(name)
+			}
+			return nil
+		}
+		if c.fileExpired(name) {
+			_ = os.Remove(name)
+			return nil
+		}
+		files = append(files, diskCacheFile{name: name, size: info.Size(), lastUse: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Println("Error sweeping cache", c.root, err)
+	}
+
+	if c.maxBytes <= 0 || total <= c.maxBytes {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUse.Before(files[j].lastUse) })
+	for _, file := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(file.name); err == nil {
+			total -= file.size
+		}
+	}
+}
+
+func (c *diskCache) fileExpired(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header, err := readDiskCacheHeader(bufio.NewReader(f))
+	return err != nil || c.expired(header)
+}
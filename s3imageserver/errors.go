@@ -0,0 +1,69 @@
+package s3imageserver
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Returned, usually wrapped, by sources and ResizeCrop, and mapped onto the response status by Handle
+var (
+	ErrNotFound          = errors.New("image not found")
+	ErrForbidden         = errors.New("access to image forbidden")
+	ErrUpstreamTimeout   = errors.New("upstream timed out")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrDecode            = errors.New("image could not be decoded")
+	ErrTooLarge          = errors.New("image too large")
+	ErrBusy              = errors.New("too many renders waiting")
+	ErrRenderTimeout     = errors.New("render timed out")
+	ErrRenderCancelled   = errors.New("render cancelled")
+)
+
+// Logged for work given up because the client went away, the status nginx uses for it
+const statusClientClosedRequest = 499
+
+var errorStatus = map[error]int{
+	ErrNotFound:          http.StatusNotFound,
+	ErrForbidden:         http.StatusForbidden,
+	ErrUpstreamTimeout:   http.StatusGatewayTimeout,
+	ErrUnsupportedFormat: http.StatusUnsupportedMediaType,
+	ErrDecode:            http.StatusUnprocessableEntity,
+	ErrTooLarge:          http.StatusRequestEntityTooLarge,
+	ErrBusy:              http.StatusServiceUnavailable,
+	ErrRenderTimeout:     http.StatusGatewayTimeout,
+	ErrRenderCancelled:   statusClientClosedRequest,
+}
+
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == ErrNotFound
+}
+
+// The response status for err, or fallback when it is not one of the typed errors
+func statusForError(err error, fallback int) int {
+	if status, ok := errorStatus[errors.Cause(err)]; ok {
+		return status
+	}
+	return fallback
+}
+
+// The error for a failed upstream request, typed when the status says why
+func upstreamStatusError(status int) error {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return errors.Wrapf(ErrNotFound, "%v error while making request", status)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.Wrapf(ErrForbidden, "%v error while making request", status)
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return errors.Wrapf(ErrUpstreamTimeout, "%v error while making request", status)
+	}
+	return errors.Errorf("%v error while making request", status)
+}
+
+// Wraps an error of an upstream request or read, reporting timeouts as ErrUpstreamTimeout
+func upstreamError(err error, message string) error {
+	if ne, ok := errors.Cause(err).(net.Error); ok && ne.Timeout() {
+		return errors.Wrapf(ErrUpstreamTimeout, "%v: %v", message, err)
+	}
+	return errors.Wrap(err, message)
+}
@@ -0,0 +1,168 @@
+package s3imageserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// How a file source treats symbolic links below its root
+const (
+	SymlinksWithinRoot = "root"
+	SymlinksDeny       = "deny"
+	SymlinksFollow     = "follow"
+)
+
+type FileConfig struct {
+	Root string `json:"root"`
+	// root (the default) follows links that stay inside the root, deny refuses every link, follow allows any target
+	Symlinks string `json:"symlinks"`
+}
+
+type fileSource struct {
+	FileConfig
+	root string
+}
+
+// An image source serving files below a local directory
+func NewFileSource(config FileConfig) *fileSource {
+	root, err := filepath.Abs(config.Root)
+	if err != nil {
+		log.Println("Could not resolve file source root", config.Root, err)
+		root = config.Root
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	} else {
+		log.Println("File source root", root, "is not readable", err)
+	}
+	return &fileSource{
+		FileConfig: config,
+		root:       root,
+	}
+}
+
+func (s *fileSource) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *fileSource) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return readStream(s.OpenImage(context.Background(), path))
+}
+
+func (s *fileSource) OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error) {
+	name, err := s.resolve(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, fileError(err, "Failed to open", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fileError(err, "Failed to stat", path)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, errors.Wrapf(ErrNotFound, "%v is a directory", path)
+	}
+	return f, fileMetadata(info), nil
+}
+
+func (s *fileSource) GetMetadata(path string) (*ImageMetadata, error) {
+	name, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fileError(err, "Failed to stat", path)
+	}
+	if info.IsDir() {
+		return nil, errors.Wrapf(ErrNotFound, "%v is a directory", path)
+	}
+	return fileMetadata(info), nil
+}
+
+// Maps the request path onto a file below the root, refusing .. segments and links the policy does not allow
+func (s *fileSource) resolve(path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", errors.Wrapf(ErrNotFound, "path %v is invalid", path)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return "", errors.Wrapf(ErrForbidden, "path %v escapes the source root", path)
+		}
+	}
+	name := filepath.Join(s.root, filepath.FromSlash(filepath.Clean("/"+path)))
+
+	switch s.Symlinks {
+	case SymlinksFollow:
+		return name, nil
+	case SymlinksDeny:
+		//every component below the root has to be a plain file or directory
+		for dir := name; dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+			info, err := os.Lstat(dir)
+			if err != nil {
+				return "", fileError(err, "Failed to stat", path)
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return "", errors.Wrapf(ErrForbidden, "path %v contains a symbolic link", path)
+			}
+		}
+		return name, nil
+	default:
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return "", fileError(err, "Failed to resolve", path)
+		}
+		if !withinDir(s.root, resolved) {
+			return "", errors.Wrapf(ErrForbidden, "path %v links outside the source root", path)
+		}
+		return resolved, nil
+	}
+}
+
+// Missing files, and paths running through a file as if it were a directory, are not found
+func fileError(err error, message, path string) error {
+	if os.IsNotExist(err) || isNotDir(err) {
+		return errors.Wrapf(ErrNotFound, "%v %v", message, path)
+	}
+	return errors.Wrapf(err, "%v %v", message, path)
+}
+
+func isNotDir(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	return err == syscall.ENOTDIR
+}
+
+func withinDir(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// The modification time is the Last-Modified, and together with the size makes up the ETag
+func fileMetadata(info os.FileInfo) *ImageMetadata {
+	return &ImageMetadata{
+		ETag:         fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime(),
+		Size:         info.Size(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(info.Name())),
+	}
+}
@@ -0,0 +1,250 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/RetroRabbit/vips"
+	"github.com/pkg/errors"
+)
+
+// Filters that can be listed in the fl parameter
+const (
+	filterGrayscale = "grayscale"
+	filterSepia     = "sepia"
+	filterInvert    = "invert"
+)
+
+const maxBlurRadius = 50
+
+// Splits [0, n) into one band per CPU and runs fn on the bands concurrently
+func parallelRange(n int, fn func(start, end int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		fn(0, n)
+		return
+	}
+	size := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += size {
+		end := minInt(start+size, n)
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			fn(start, end)
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	dst := image.NewNRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+func (fs *FormatSettings) hasFilters() bool {
+	return fs.Pixelation > 0 || fs.BoxBlur > 0 || fs.GaussianBlur > 0 || fs.Brightness != 0 || fs.Contrast != 0 ||
+		fs.Grayscale || fs.Sepia || fs.Invert
+}
+
+// Decodes the PNG vips produced once, redacts the mapped regions and runs the filters. vips then encodes the result in
+// the requested format, so quality and interlacing apply just as they do without filters.
+func postProcess(resized []byte, settings *FormatSettings, inWidth, inHeight int, mapRegions bool) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(resized))
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecode, "Failed to decode image for filtering: %v", err)
+	}
+	dst := toNRGBA(img)
+	if mapRegions {
+		scale, offset := resizeGeometry(inWidth, inHeight, settings)
+		redactRegions(dst, settings.Regions, inWidth, inHeight, scale, offset)
+	}
+	applyFilters(dst, settings)
+
+	out := &bytes.Buffer{}
+	if err = png.Encode(out, dst); err != nil {
+		return nil, errors.Wrap(err, "Failed to encode filtered image")
+	}
+	//without a size vips keeps the image as it is and only encodes it
+	encoded, err := vips.Resize(out.Bytes(), vips.Options{
+		Interpolator: vips.BICUBIC,
+		Interlaced:   settings.Interlaced,
+		Quality:      settings.Quality,
+		Format:       settings.OutputFormat,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode filtered image")
+	}
+	return encoded, nil
+}
+
+// Runs the filters in a fixed order: blurs, pixelation, brightness and contrast, then the colour filters
+func applyFilters(img *image.NRGBA, settings *FormatSettings) {
+	bounds := img.Bounds()
+	if settings.BoxBlur > 0 {
+		boxBlurRect(img, bounds, settings.BoxBlur, 1)
+	}
+	if settings.GaussianBlur > 0 {
+		boxBlurRect(img, bounds, gaussianBoxRadius(settings.GaussianBlur), 3)
+	}
+	if settings.Pixelation > 0 {
+		pixelateRect(img, bounds, int(float64(bounds.Dx())*(float64(settings.Pixelation)/100.0)))
+	}
+	if settings.Brightness != 0 || settings.Contrast != 0 {
+		brightness := float32(settings.Brightness) / 100
+		contrast := float32(100+settings.Contrast) / 100
+		pointFilter(img, bounds, func(px pixel) pixel {
+			adjust := func(c float32) float32 { return clampf32((c-0.5)*contrast + 0.5 + brightness) }
+			return pixel{adjust(px.R), adjust(px.G), adjust(px.B), px.A}
+		})
+	}
+	if settings.Grayscale {
+		pointFilter(img, bounds, func(px pixel) pixel {
+			l := 0.299*px.R + 0.587*px.G + 0.114*px.B
+			return pixel{l, l, l, px.A}
+		})
+	}
+	if settings.Sepia {
+		pointFilter(img, bounds, func(px pixel) pixel {
+			return pixel{
+				clampf32(0.393*px.R + 0.769*px.G + 0.189*px.B),
+				clampf32(0.349*px.R + 0.686*px.G + 0.168*px.B),
+				clampf32(0.272*px.R + 0.534*px.G + 0.131*px.B),
+				px.A,
+			}
+		})
+	}
+	if settings.Invert {
+		pointFilter(img, bounds, func(px pixel) pixel {
+			return pixel{1 - px.R, 1 - px.G, 1 - px.B, px.A}
+		})
+	}
+}
+
+// Applies fn to every pixel of rect, a band of rows per CPU
+func pointFilter(img *image.NRGBA, rect image.Rectangle, fn func(pixel) pixel) {
+	pixGetter := newPixelGetter(img)
+	pixSetter := newPixelSetter(img)
+	parallelRange(rect.Dy(), func(start, end int) {
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				pixSetter.setPixel(x, y, fn(pixGetter.getPixel(x, y)))
+			}
+		}
+	})
+}
+
+// Blurs rect with passes of a box blur, three passes come close to a gaussian blur. The horizontal pass is split
+// by rows and the vertical one by columns. Samples are clamped to rect so nothing from outside bleeds in.
+func boxBlurRect(img *image.NRGBA, rect image.Rectangle, radius, passes int) {
+	if radius > maxBlurRadius {
+		radius = maxBlurRadius
+	}
+	pixGetter := newPixelGetter(img)
+	pixSetter := newPixelSetter(img)
+	for pass := 0; pass < passes; pass++ {
+		parallelRange(rect.Dy(), func(start, end int) {
+			line := make([]pixel, rect.Dx())
+			blurred := make([]pixel, rect.Dx())
+			for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+				for x := range line {
+					line[x] = pixGetter.getPixel(rect.Min.X+x, y)
+				}
+				boxBlurLine(line, blurred, radius)
+				for x, px := range blurred {
+					pixSetter.setPixel(rect.Min.X+x, y, px)
+				}
+			}
+		})
+		parallelRange(rect.Dx(), func(start, end int) {
+			line := make([]pixel, rect.Dy())
+			blurred := make([]pixel, rect.Dy())
+			for x := rect.Min.X + start; x < rect.Min.X+end; x++ {
+				for y := range line {
+					line[y] = pixGetter.getPixel(x, rect.Min.Y+y)
+				}
+				boxBlurLine(line, blurred, radius)
+				for y, px := range blurred {
+					pixSetter.setPixel(x, rect.Min.Y+y, px)
+				}
+			}
+		})
+	}
+}
+
+// A running sum over the window, so the cost does not depend on the radius
+func boxBlurLine(src, dst []pixel, radius int) {
+	var sum pixel
+	var cnt float32
+	add := func(px pixel, sign float32) {
+		sum.R += sign * px.R
+		sum.G += sign * px.G
+		sum.B += sign * px.B
+		sum.A += sign * px.A
+		cnt += sign
+	}
+	for i := 0; i < radius && i < len(src); i++ {
+		add(src[i], 1)
+	}
+	for i := range src {
+		if i+radius < len(src) {
+			add(src[i+radius], 1)
+		}
+		if i-radius-1 >= 0 {
+			add(src[i-radius-1], -1)
+		}
+		dst[i] = pixel{sum.R / cnt, sum.G / cnt, sum.B / cnt, sum.A / cnt}
+	}
+}
+
+// The radius of three box blurs that together approximate a gaussian blur with the given sigma
+func gaussianBoxRadius(sigma float32) int {
+	radius := int(math.Round((math.Sqrt(4*float64(sigma)*float64(sigma)+1) - 1) / 2))
+	if radius < 1 {
+		radius = 1
+	}
+	return radius
+}
+
+// Parses the comma separated fl parameter, unknown filters are ignored
+func parseFilterList(value string) (grayscale, sepia, invert bool) {
+	for _, name := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case filterGrayscale:
+			grayscale = true
+		case filterSepia:
+			sepia = true
+		case filterInvert:
+			invert = true
+		}
+	}
+	return
+}
+
+func filterList(settings FormatSettings) string {
+	var names []string
+	if settings.Grayscale {
+		names = append(names, filterGrayscale)
+	}
+	if settings.Sepia {
+		names = append(names, filterSepia)
+	}
+	if settings.Invert {
+		names = append(names, filterInvert)
+	}
+	return strings.Join(names, ",")
+}
+
+func clampf32(v float32) float32 {
+	return minf32(maxf32(v, 0), 1)
+}
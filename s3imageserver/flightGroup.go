@@ -0,0 +1,88 @@
+package s3imageserver
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Deduplicates concurrent calls with the same key, every caller waiting on a key gets the result and error of the
+// one call that ran
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.doContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// Like do, but a caller stops waiting when its ctx is done. The context passed to fn is cancelled once every caller
+// waiting on the key has gone, so one client disconnecting does not abort the call for the others.
+func (g *flightGroup) doContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.Background())
+		call = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			call.val, call.err = callRecovering(callCtx, fn)
+			g.mu.Lock()
+			g.forget(key, call)
+			g.mu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			//later callers start over instead of joining the cancelled call
+			g.forget(key, call)
+			call.cancel()
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) forget(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// fn runs on a goroutine of its own, where a panic would take the whole server down instead of failing the request
+func callRecovering(ctx context.Context, fn func(context.Context) (interface{}, error)) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic: %v\n%s", r, debug.Stack())
+			val, err = nil, errors.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
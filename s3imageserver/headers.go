@@ -0,0 +1,87 @@
+package s3imageserver
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RetroRabbit/vips"
+)
+
+// One week, matching the cache_time default of the original configuration
+const defaultCacheMaxAge = 604800
+
+var contentTypes = map[vips.ImageType]string{
+	vips.JPEG: "image/jpeg",
+	vips.PNG:  "image/png",
+	vips.GIF:  "image/gif",
+	vips.WEBP: "image/webp",
+}
+
+type cachePolicy struct {
+	control string
+	maxAge  int
+	vary    []string
+}
+
+func newCachePolicy(config HandlerConfig) cachePolicy {
+	policy := cachePolicy{maxAge: defaultCacheMaxAge}
+	if config.Defaults != nil && config.Defaults.CacheMaxAge != nil {
+		policy.maxAge = *config.Defaults.CacheMaxAge
+	}
+
+	visibility := "public"
+	if config.VerificationRequired != nil && *config.VerificationRequired {
+		//the response depends on the credentials, shared caches must not mix them up
+		visibility = "private"
+		policy.vary = append(policy.vary, "Authorization", "Cookie")
+	}
+
+	switch {
+	case config.CacheControl != "":
+		policy.control = config.CacheControl
+	case policy.maxAge > 0:
+		policy.control = visibility + ", max-age=" + strconv.Itoa(policy.maxAge)
+	default:
+		policy.control = "no-cache"
+	}
+	return policy
+}
+
+// Sets Cache-Control, Expires and Vary for a successful response, extra lists request headers the output depended on
+func (cp cachePolicy) setHeaders(w http.ResponseWriter, now time.Time, extra ...string) {
+	w.Header().Set("Cache-Control", cp.control)
+	if cp.maxAge > 0 {
+		w.Header().Set("Expires", now.Add(time.Duration(cp.maxAge)*time.Second).UTC().Format(http.TimeFormat))
+	}
+	vary := append(append([]string{}, cp.vary...), extra...)
+	if len(vary) > 0 {
+		w.Header().Set("Vary", strings.Join(vary, ", "))
+	}
+}
+
+// Error responses must never be cached as if they were the real image
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func setContentHeaders(w http.ResponseWriter, format vips.ImageType, length int) {
+	if contentType, ok := contentTypes[format]; ok {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", contentTypes[vips.JPEG])
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(length))
+}
+
+func writeImage(w http.ResponseWriter, caching cachePolicy, img *CachedImage, vary ...string) {
+	caching.setHeaders(w, time.Now(), vary...)
+	setValidatorHeaders(w, img.ETag, img.LastModified)
+	setContentHeaders(w, img.Format, len(img.Data))
+	_, err := w.Write(img.Data)
+	if err != nil {
+		log.Printf("Error writing result %+v", err)
+	}
+}
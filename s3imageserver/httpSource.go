@@ -0,0 +1,267 @@
+package s3imageserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHTTPSourceTimeout   = 10
+	defaultHTTPSourceMaxBytes  = 32 << 20
+	defaultHTTPSourceRedirects = 3
+)
+
+// Networks an http source refuses to connect to unless they are listed in allowed_networks
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // NAT64, reaches the IPv4 address it embeds
+	"2002::/16",      // 6to4, also embeds an IPv4 address
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+	"ff00::/8",       // multicast
+)
+
+type HTTPConfig struct {
+	// the request path is appended to this URL
+	BaseURL string `json:"base_url"`
+	// without a base_url the first path segment names the host, which has to be listed here, *.example.com matches subdomains
+	AllowedHosts []string `json:"allowed_hosts"`
+	// scheme used for allowed_hosts, defaults to https
+	Scheme          string   `json:"scheme"`
+	Timeout         int      `json:"timeout"`
+	MaxBytes        int64    `json:"max_bytes"`
+	MaxRedirects    *int     `json:"max_redirects"`
+	AllowedNetworks []string `json:"allowed_networks"`
+}
+
+type httpSource struct {
+	HTTPConfig
+	base    *url.URL
+	allowed []*net.IPNet
+	client  *http.Client
+}
+
+// An image source fetching from plain web servers
+func NewHTTPSource(config HTTPConfig) *httpSource {
+	s := &httpSource{HTTPConfig: config}
+	if config.BaseURL != "" {
+		base, err := url.Parse(config.BaseURL)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			log.Println("Invalid http source base_url", config.BaseURL, err)
+		} else {
+			s.base = base
+		}
+	}
+	if s.Scheme == "" {
+		s.Scheme = "https"
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = defaultHTTPSourceTimeout
+	}
+	if s.MaxBytes <= 0 {
+		s.MaxBytes = defaultHTTPSourceMaxBytes
+	}
+	s.allowed = parseNetworks(config.AllowedNetworks...)
+
+	dialer := &net.Dialer{
+		Timeout: time.Duration(s.Timeout) * time.Second,
+		//checked on the resolved address of every connection, so DNS answers and redirects cannot point inwards
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return s.checkAddress(address)
+		},
+	}
+	s.client = &http.Client{
+		Timeout: time.Duration(s.Timeout) * time.Second,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   time.Duration(s.Timeout) * time.Second,
+			ResponseHeaderTimeout: time.Duration(s.Timeout) * time.Second,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: s.checkRedirect,
+	}
+	return s
+}
+
+func (s *httpSource) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *httpSource) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return readStream(s.OpenImage(context.Background(), path))
+}
+
+func (s *httpSource) OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error) {
+	resp, err := s.do(ctx, "GET", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.ContentLength > s.MaxBytes {
+		resp.Body.Close()
+		return nil, nil, errors.Wrapf(ErrTooLarge, "%v is %v bytes, more than the %v allowed", path, resp.ContentLength, s.MaxBytes)
+	}
+	body := &maxBytesReader{ReadCloser: resp.Body, remaining: s.MaxBytes, max: s.MaxBytes, path: path}
+	return body, metadataFromResponse(resp), nil
+}
+
+func (s *httpSource) GetMetadata(path string) (*ImageMetadata, error) {
+	resp, err := s.do(context.Background(), "HEAD", path)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return metadataFromResponse(resp), nil
+}
+
+func (s *httpSource) do(ctx context.Context, method, path string) (*http.Response, error) {
+	reqURL, err := s.url(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, reqURL.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create request")
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, upstreamError(err, "Failed to fetch")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, upstreamStatusError(resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Fails with ErrTooLarge once the body grows past max bytes
+type maxBytesReader struct {
+	io.ReadCloser
+	remaining int64
+	max       int64
+	path      string
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	//read one byte more than allowed to tell a body of exactly max bytes from a longer one
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) > r.remaining {
+		n, r.remaining = int(r.remaining), 0
+		return n, errors.Wrapf(ErrTooLarge, "%v is more than the %v bytes allowed", r.path, r.max)
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// Appends the path to the base URL, or without one takes the host from its first segment
+func (s *httpSource) url(path string) (*url.URL, error) {
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return nil, errors.Wrapf(ErrForbidden, "path %v is invalid", path)
+		}
+	}
+	if s.base != nil {
+		u := *s.base
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+		u.RawPath = ""
+		return &u, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) < 2 || !s.hostAllowed(parts[0]) {
+		return nil, errors.Wrapf(ErrForbidden, "host of %v is not allowed", path)
+	}
+	return &url.URL{Scheme: s.Scheme, Host: parts[0], Path: "/" + parts[1]}, nil
+}
+
+func (s *httpSource) hostAllowed(host string) bool {
+	if s.base != nil {
+		return strings.EqualFold(host, s.base.Host)
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range s.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redirects have to stay on allowed hosts and within max_redirects
+func (s *httpSource) checkRedirect(req *http.Request, via []*http.Request) error {
+	max := defaultHTTPSourceRedirects
+	if s.MaxRedirects != nil {
+		max = *s.MaxRedirects
+	}
+	if len(via) > max {
+		return errors.Errorf("stopped after %v redirects", max)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return errors.Errorf("redirect to %v is not allowed", req.URL)
+	}
+	if !s.hostAllowed(req.URL.Host) {
+		return errors.Errorf("redirect to host %v is not allowed", req.URL.Host)
+	}
+	return nil
+}
+
+func (s *httpSource) checkAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("could not parse address %v", address)
+	}
+	for _, network := range s.allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return errors.Errorf("connecting to %v is not allowed", ip)
+		}
+	}
+	return nil
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Println("Invalid network", cidr, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,81 @@
+package s3imageserver
+
+import "testing"
+
+func TestHTTPSourceCheckAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed []string
+		ok      bool
+	}{
+		{"93.184.216.34:443", nil, true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", nil, true},
+		{"0.0.0.0:80", nil, false},
+		{"10.1.2.3:80", nil, false},
+		{"100.64.0.1:80", nil, false},
+		{"127.0.0.1:80", nil, false},
+		{"169.254.169.254:80", nil, false},
+		{"172.16.0.1:80", nil, false},
+		{"172.32.0.1:80", nil, true},
+		{"192.168.1.1:80", nil, false},
+		{"224.0.0.1:80", nil, false},
+		{"255.255.255.255:80", nil, false},
+		{"[::]:80", nil, false},
+		{"[::1]:80", nil, false},
+		{"[fc00::1]:80", nil, false},
+		{"[fd12:3456::1]:80", nil, false},
+		{"[fe80::1]:80", nil, false},
+		{"[fe80::1%eth0]:80", nil, false},
+		{"[ff02::1]:80", nil, false},
+		// IPv4-mapped IPv6 addresses are checked as the IPv4 address they carry
+		{"[::ffff:127.0.0.1]:80", nil, false},
+		{"[::ffff:169.254.169.254]:80", nil, false},
+		{"[::ffff:10.0.0.1]:80", nil, false},
+		{"[::ffff:93.184.216.34]:80", nil, true},
+		{"192.0.0.8:80", nil, false},
+		{"198.18.0.1:80", nil, false},
+		{"198.19.255.255:80", nil, false},
+		{"198.20.0.1:80", nil, true},
+		// NAT64 and 6to4 addresses carry an IPv4 address and are blocked whichever one it is
+		{"[64:ff9b::a9fe:a9fe]:80", nil, false},
+		{"[64:ff9b::7f00:1]:80", nil, false},
+		{"[64:ff9b::5db8:d822]:80", nil, false},
+		{"[2002:a9fe:a9fe::1]:80", nil, false},
+		{"[2002:0a00:0001::1]:80", nil, false},
+		{"not an address", nil, false},
+		// allowed_networks let a source reach networks that are blocked otherwise
+		{"10.1.2.3:80", []string{"10.1.0.0/16"}, true},
+		{"10.2.0.1:80", []string{"10.1.0.0/16"}, false},
+		{"[::ffff:10.1.2.3]:80", []string{"10.1.0.0/16"}, true},
+		{"127.0.0.1:8080", []string{"127.0.0.1/32"}, true},
+		{"[fd00::5]:80", []string{"fd00::/64"}, true},
+		{"[64:ff9b::5db8:d822]:80", []string{"64:ff9b::/96"}, true},
+		{"169.254.169.254:80", []string{"invalid", "10.0.0.0/8"}, false},
+	}
+	for _, test := range tests {
+		source := NewHTTPSource(HTTPConfig{AllowedNetworks: test.allowed})
+		err := source.checkAddress(test.address)
+		if (err == nil) != test.ok {
+			t.Errorf("checkAddress(%v) with allowed networks %v = %v, want allowed %v", test.address, test.allowed, err, test.ok)
+		}
+	}
+}
+
+func TestHTTPSourceURLRefusals(t *testing.T) {
+	tests := []struct {
+		config HTTPConfig
+		path   string
+		status int
+	}{
+		{HTTPConfig{AllowedHosts: []string{"images.example.com"}}, "/images.example.com/a.jpg", 0},
+		{HTTPConfig{AllowedHosts: []string{"images.example.com"}}, "/other.example.com/a.jpg", 403},
+		{HTTPConfig{AllowedHosts: []string{"images.example.com"}}, "/images.example.com", 403},
+		{HTTPConfig{BaseURL: "https://images.example.com/media"}, "/a/../../b.jpg", 403},
+	}
+	for _, test := range tests {
+		_, err := NewHTTPSource(test.config).url(test.path)
+		if status := statusForError(err, 0); (err == nil) != (test.status == 0) || status != test.status {
+			t.Errorf("url(%v) = %v with status %v, want status %v", test.path, err, status, test.status)
+		}
+	}
+}
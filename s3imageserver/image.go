@@ -1,10 +1,16 @@
 package s3imageserver
 
 import (
+	"bytes"
+	"log"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/RetroRabbit/vips"
 	"github.com/gosexy/to"
+	"github.com/pkg/errors"
 )
 
 type FormatSettings struct {
@@ -20,6 +26,16 @@ type FormatSettings struct {
 	OutputFormat  vips.ImageType
 	HeightMissing bool
 	WidthMissing  bool
+	Regions       []Region
+	BoxBlur       int
+	GaussianBlur  float32
+	Brightness    int
+	Contrast      int
+	Grayscale     bool
+	Sepia         bool
+	Invert        bool
+	Page          int
+	Timestamp     time.Duration
 }
 
 var allowedTypes = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
@@ -90,6 +106,27 @@ func GetFormatSettings(r *http.Request, config *FormatDefaults) *FormatSettings
 			pixelation = 0
 		}
 	}
+	regions, err := requestRegions(r.URL.Query())
+	if err != nil {
+		//Handle turns these requests away, anyone else still never gets to see what was meant to be hidden
+		log.Println("Invalid regions, redacting the whole image:", err)
+		regions = []Region{{Mode: RegionPixelate, Width: 100, Height: 100, Percent: true}}
+	}
+	boxBlur := clampInt(int(to.Float64(r.URL.Query().Get("bx"))), 0, maxBlurRadius)
+	gaussianBlur := float32(to.Float64(r.URL.Query().Get("gb")))
+	if gaussianBlur > maxBlurRadius {
+		gaussianBlur = maxBlurRadius
+	} else if gaussianBlur < 0 {
+		gaussianBlur = 0
+	}
+	brightness := clampInt(int(to.Float64(r.URL.Query().Get("br"))), -100, 100)
+	contrast := clampInt(int(to.Float64(r.URL.Query().Get("ct"))), -100, 100)
+	grayscale, sepia, invert := parseFilterList(r.URL.Query().Get("fl"))
+	page := clampInt(int(to.Float64(r.URL.Query().Get("page"))), 0, maxPreviewPage)
+	if page == 1 {
+		page = 0
+	}
+	timestamp := parseTimestamp(r.URL.Query().Get("ts"))
 	f := getFormatSupported(r.URL.Query().Get("f"), getFormatSupported(config.DefaultImageFormat, vips.JPEG))
 	return &FormatSettings{
 		Height:        height,
@@ -104,17 +141,133 @@ func GetFormatSettings(r *http.Request, config *FormatDefaults) *FormatSettings
 		OutputFormat:  f,
 		HeightMissing: heightMissing,
 		WidthMissing:  widthMissing,
+		Regions:       regions,
+		BoxBlur:       boxBlur,
+		GaussianBlur:  gaussianBlur,
+		Brightness:    brightness,
+		Contrast:      contrast,
+		Grayscale:     grayscale,
+		Sepia:         sepia,
+		Invert:        invert,
+		Page:          page,
+		Timestamp:     timestamp,
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
 	}
+	return v
 }
 
 func getFormatSupported(format string, def vips.ImageType) vips.ImageType {
-	if f, ok := allowedMap[format]; ok {
+	if f, ok := allowedMap[normalizeFormat(format)]; ok {
 		return f
 	}
 	return def
 }
 
+// Accepts formats with or without the leading dot, in any case, and maps jpeg to .jpg
+func normalizeFormat(format string) string {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		return ""
+	}
+	if !strings.HasPrefix(format, ".") {
+		format = "." + format
+	}
+	if format == ".jpeg" {
+		format = ".jpg"
+	}
+	return format
+}
+
+// Detects the format from the first bytes of the image, returns an empty string when it is not an image we know
+func sniffFormat(image []byte) string {
+	switch {
+	case bytes.HasPrefix(image, []byte{0xff, 0xd8}):
+		return ".jpg"
+	case bytes.HasPrefix(image, []byte{0x89, 0x50, 0x4e, 0x47}):
+		return ".png"
+	case bytes.HasPrefix(image, []byte("GIF8")):
+		return ".gif"
+	case len(image) >= 12 && bytes.HasPrefix(image, []byte("RIFF")) && bytes.Equal(image[8:12], []byte("WEBP")):
+		return ".webp"
+	}
+	return ""
+}
+
+// The set of formats a route accepts, a nil set allows everything
+type formatSet map[string]bool
+
+func newFormatSet(formats []string) formatSet {
+	if len(formats) == 0 {
+		return nil
+	}
+	set := formatSet{}
+	for _, format := range formats {
+		set[normalizeFormat(format)] = true
+	}
+	return set
+}
+
+func (fs formatSet) allows(format string) bool {
+	return fs == nil || fs[normalizeFormat(format)]
+}
+
+// Checks the input path extension, unknown extensions are left for sniffing once the image is fetched
+func (fs formatSet) allowsPath(p string) bool {
+	ext := normalizeFormat(path.Ext(p))
+	for _, known := range allowedTypes {
+		if normalizeFormat(known) == ext {
+			return fs.allows(ext)
+		}
+	}
+	return true
+}
+
+// Picks the output format, requested formats that are unknown or not allowed are rejected instead of falling back
+func (fs formatSet) outputFormat(requested string, def vips.ImageType) (vips.ImageType, bool) {
+	if fs == nil {
+		return getFormatSupported(requested, def), true
+	}
+	if requested != "" {
+		f, ok := allowedMap[normalizeFormat(requested)]
+		return f, ok && fs.allows(requested)
+	}
+	if fs.allows(friendlyTypeNames[def]) {
+		return def, true
+	}
+	for _, name := range allowedTypes {
+		if f, ok := allowedMap[name]; ok && fs.allows(name) {
+			return f, true
+		}
+	}
+	return def, false
+}
+
 func ResizeCrop(image []byte, settings *FormatSettings) ([]byte, error) {
+	//vips only knows the formats sniffFormat does, anything else would fail as if the image were broken
+	if sniffFormat(image) == "" {
+		return nil, errors.Wrap(ErrUnsupportedFormat, "Failed to resize")
+	}
+	var inWidth, inHeight int
+	if len(settings.Regions) > 0 {
+		var err error
+		if inWidth, inHeight, err = sourceSize(image); err != nil {
+			return nil, err
+		}
+		//the feature crop is only known after resizing, so redact the source instead of mapping the regions
+		if settings.FeatureCrop {
+			if image, err = redactSource(image, settings.Regions); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	options := vips.Options{
 		Width:         settings.Width,
 		WidthMissing:  settings.WidthMissing,
@@ -131,5 +284,19 @@ func ResizeCrop(image []byte, settings *FormatSettings) ([]byte, error) {
 		Enlarge:       settings.Enlarge,
 		BlurAmount:    settings.BlurAmount,
 	}
-	return vips.Resize(image, options)
+	//filters run on the resized image, it is smaller and sizes like the pixelation block are relative to the output
+	mapRegions := len(settings.Regions) > 0 && !settings.FeatureCrop
+	postProcessing := mapRegions || settings.hasFilters()
+	if postProcessing {
+		//lossless until the filters are done, the requested format is encoded once at the end
+		options.Format, options.Interlaced = vips.PNG, false
+	}
+	resized, err := vips.Resize(image, options)
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecode, "Failed to resize: %v", err)
+	}
+	if !postProcessing {
+		return resized, nil
+	}
+	return postProcess(resized, settings, inWidth, inHeight, mapRegions)
 }
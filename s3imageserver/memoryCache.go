@@ -0,0 +1,238 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type CacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// A least recently used cache bounded by the total size of its values in bytes
+type memoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	items    map[string]*list.Element
+	order    *list.List
+	hits     uint64
+	misses   uint64
+}
+
+type memoryCacheEntry struct {
+	key   string
+	path  string
+	value interface{}
+	size  int64
+}
+
+func newMemoryCache(maxBytes int64) *memoryCache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *memoryCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.order.MoveToFront(element)
+	return element.Value.(*memoryCacheEntry).value, true
+}
+
+// Looks a value up without counting it as a use
+func (c *memoryCache) peek(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		return element.Value.(*memoryCacheEntry).value, true
+	}
+	return nil, false
+}
+
+// Values larger than the whole cache are not stored at all
+func (c *memoryCache) set(key, path string, value interface{}, size int64) {
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+	c.items[key] = c.order.PushFront(&memoryCacheEntry{key: key, path: path, value: value, size: size})
+	c.size += size
+	for c.size > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Removes the entries under keyPrefix for path, or for every path starting with it when prefix is set
+func (c *memoryCache) purge(keyPrefix, path string, prefix bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*memoryCacheEntry)
+		if strings.HasPrefix(entry.key, keyPrefix) && (entry.path == path || prefix && strings.HasPrefix(entry.path, path)) {
+			c.removeElement(element)
+			removed++
+		}
+		element = next
+	}
+	return removed
+}
+
+func (c *memoryCache) removeElement(element *list.Element) {
+	entry := c.order.Remove(element).(*memoryCacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+func (c *memoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:     atomic.LoadUint64(&c.hits),
+		Misses:   atomic.LoadUint64(&c.misses),
+		Entries:  c.order.Len(),
+		Bytes:    c.size,
+		MaxBytes: c.maxBytes,
+	}
+}
+
+// Keeps rendered images in memory in front of a slower cache, next may be nil
+type memoryTier struct {
+	memory *memoryCache
+	prefix string
+	next   DerivativeCache
+}
+
+func newMemoryTier(memory *memoryCache, route string, next DerivativeCache) *memoryTier {
+	return &memoryTier{
+		memory: memory,
+		prefix: route + "\x00",
+		next:   next,
+	}
+}
+
+func (t *memoryTier) key(path, variant string) string {
+	return t.prefix + path + "\x00" + variant
+}
+
+func (t *memoryTier) Get(path, variant string) (*CachedImage, bool) {
+	if value, ok := t.memory.get(t.key(path, variant)); ok {
+		return value.(*CachedImage), true
+	}
+	if t.next == nil {
+		return nil, false
+	}
+	img, ok := t.next.Get(path, variant)
+	if ok {
+		t.memory.set(t.key(path, variant), path, img, int64(len(img.Data)))
+	}
+	return img, ok
+}
+
+func (t *memoryTier) Set(path, variant string, img *CachedImage) error {
+	t.memory.set(t.key(path, variant), path, img, int64(len(img.Data)))
+	if t.next == nil {
+		return nil
+	}
+	return t.next.Set(path, variant, img)
+}
+
+func (t *memoryTier) Purge(path string, prefix bool) (int, error) {
+	removed := t.memory.purge(t.prefix, path, prefix)
+	if pc, ok := t.next.(PurgeableCache); ok {
+		n, err := pc.Purge(path, prefix)
+		return removed + n, err
+	}
+	return removed, nil
+}
+
+type sourceImage struct {
+	data []byte
+	meta *ImageMetadata
+}
+
+// Keeps source images in memory, keyed by source name and path
+type memoryCachedSource struct {
+	ImageSource
+	memory *memoryCache
+	prefix string
+}
+
+func newMemoryCachedSource(source ImageSource, memory *memoryCache, sourceName string) *memoryCachedSource {
+	return &memoryCachedSource{
+		ImageSource: source,
+		memory:      memory,
+		prefix:      sourceName + "\x00",
+	}
+}
+
+func (s *memoryCachedSource) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *memoryCachedSource) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return s.getImage(context.Background(), path)
+}
+
+// Serves a copy from memory, which also means a miss reads the whole image from the wrapped source first
+func (s *memoryCachedSource) OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error) {
+	data, meta, err := s.getImage(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), meta, nil
+}
+
+func (s *memoryCachedSource) getImage(ctx context.Context, path string) ([]byte, *ImageMetadata, error) {
+	key := s.prefix + sourceKey(ctx, s.ImageSource, path)
+	if value, ok := s.memory.get(key); ok {
+		cached := value.(*sourceImage)
+		return cached.data, cached.meta, nil
+	}
+	data, meta, err := getImageWithMetadata(ctx, s.ImageSource, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.memory.set(key, path, &sourceImage{data: data, meta: meta}, int64(len(data)))
+	return data, meta, nil
+}
+
+func (s *memoryCachedSource) UsesPreviewOptions() bool {
+	return usesPreviewOptions(s.ImageSource)
+}
+
+// Answers from memory when possible, otherwise asks the wrapped source if it can look metadata up
+func (s *memoryCachedSource) GetMetadata(path string) (*ImageMetadata, error) {
+	if value, ok := s.memory.peek(s.prefix + path); ok {
+		return value.(*sourceImage).meta, nil
+	}
+	if ms, ok := s.ImageSource.(MetadataSource); ok {
+		return ms.GetMetadata(path)
+	}
+	return nil, errMetadataUnsupported
+}
@@ -0,0 +1,77 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/RetroRabbit/vips"
+)
+
+// Picks the output format from the Accept header, ok is false when the choice depends on the source having alpha
+// and no image was passed in yet
+func negotiateFormat(accept string, allowed formatSet, img []byte) (vips.ImageType, bool) {
+	if acceptsType(accept, "image/webp") && allowed.allows(".webp") {
+		return vips.WEBP, true
+	}
+	if img == nil {
+		return vips.UNKNOWN, false
+	}
+	if hasAlpha(img) && allowed.allows(".png") {
+		return vips.PNG, true
+	}
+	f, _ := allowed.outputFormat("", vips.JPEG)
+	return f, true
+}
+
+// Only explicit mentions count, browsers send */* without supporting every format
+func acceptsType(accept, mimeType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mimeType) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Looks at the headers of PNG, WebP and GIF images for an alpha channel or transparency
+func hasAlpha(img []byte) bool {
+	switch sniffFormat(img) {
+	case ".png":
+		if len(img) > 25 && (img[25] == 4 || img[25] == 6) {
+			return true
+		}
+		trns := bytes.Index(img, []byte("tRNS"))
+		return trns >= 0 && trns < bytes.Index(img, []byte("IDAT"))
+	case ".webp":
+		if len(img) > 24 && bytes.Equal(img[12:16], []byte("VP8X")) {
+			return img[20]&0x10 != 0
+		}
+		if len(img) > 24 && bytes.Equal(img[12:16], []byte("VP8L")) {
+			return img[24]&0x10 != 0
+		}
+	case ".gif":
+		//graphic control extension with the transparent colour flag set
+		gce := []byte{0x21, 0xf9, 0x04}
+		for i := bytes.Index(img, gce); i >= 0 && i+3 < len(img); {
+			if img[i+3]&0x01 != 0 {
+				return true
+			}
+			next := bytes.Index(img[i+3:], gce)
+			if next < 0 {
+				break
+			}
+			i += 3 + next
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package s3imageserver
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the width previews are rendered at when the request does not set one
+	defaultPreviewWidth = 1024
+	maxPreviewPage      = 100000
+	maxPreviewTimestamp = 24 * time.Hour
+)
+
+// Settings of the request that preview renderers may use, passed along in the context of OpenImage
+type PreviewOptions struct {
+	Page  int
+	Width int
+	// the position in a video to take a frame from
+	Time time.Duration
+}
+
+type previewOptionsKey struct{}
+
+func WithPreviewOptions(ctx context.Context, options PreviewOptions) context.Context {
+	return context.WithValue(ctx, previewOptionsKey{}, options)
+}
+
+// The options of the request, with defaults for anything it did not set
+func PreviewOptionsFrom(ctx context.Context) PreviewOptions {
+	options, _ := ctx.Value(previewOptionsKey{}).(PreviewOptions)
+	if options.Page < 1 {
+		options.Page = 1
+	}
+	if options.Width <= 0 {
+		options.Width = defaultPreviewWidth
+	}
+	return options
+}
+
+func (o PreviewOptions) key() string {
+	return "page=" + strconv.Itoa(o.Page) + "&width=" + strconv.Itoa(o.Width) + "&time=" + o.seconds()
+}
+
+func (o PreviewOptions) seconds() string {
+	return strconv.FormatFloat(o.Time.Seconds(), 'f', -1, 64)
+}
+
+// Parses a position given in seconds (12.5), as a duration (12.5s, 1m30s) or as a clock (01:30, 1:02:03.5), rounded
+// to milliseconds so equal positions share cache entries. Invalid positions are ignored.
+func parseTimestamp(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	var position time.Duration
+	if strings.Contains(value, ":") {
+		parts := strings.Split(value, ":")
+		if len(parts) > 3 {
+			return 0
+		}
+		seconds := 0.0
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil || v < 0 || (i < len(parts)-1 && v != math.Trunc(v)) {
+				return 0
+			}
+			seconds = seconds*60 + v
+		}
+		position = time.Duration(seconds * float64(time.Second))
+	} else if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		position = time.Duration(seconds * float64(time.Second))
+	} else if d, err := time.ParseDuration(value); err == nil {
+		position = d
+	}
+	if position < 0 || position > maxPreviewTimestamp {
+		return 0
+	}
+	return position.Round(time.Millisecond)
+}
+
+// Optionally implemented by sources whose image depends on the PreviewOptions, so they are fetched and cached once
+// per options instead of once per path
+type PreviewOptionsSource interface {
+	UsesPreviewOptions() bool
+}
+
+func usesPreviewOptions(source interface{}) bool {
+	ps, ok := source.(PreviewOptionsSource)
+	return ok && ps.UsesPreviewOptions()
+}
+
+// The key a source image is fetched and cached under
+func sourceKey(ctx context.Context, source ImageSource, path string) string {
+	if !usesPreviewOptions(source) {
+		return path
+	}
+	return path + "\x00" + PreviewOptionsFrom(ctx).key()
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package s3imageserver
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kills the command along with everything it started, like the workers of LibreOffice
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+// Runs the command through sh to set its resource limits with ulimit
+func limitCommand(command []string, limits PreviewLimits) []string {
+	var ulimits []string
+	if limits.MaxMemoryMB > 0 {
+		ulimits = append(ulimits, "ulimit -v "+strconv.Itoa(limits.MaxMemoryMB*1024))
+	}
+	if limits.MaxCPUSeconds > 0 {
+		ulimits = append(ulimits, "ulimit -t "+strconv.Itoa(limits.MaxCPUSeconds))
+	}
+	if len(ulimits) == 0 {
+		return command
+	}
+	script := strings.Join(ulimits, " && ") + ` && exec "$@"`
+	return append([]string{"/bin/sh", "-c", script, "sh"}, command...)
+}
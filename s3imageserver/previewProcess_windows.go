@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package s3imageserver
+
+import (
+	"log"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
+
+func limitCommand(command []string, limits PreviewLimits) []string {
+	if limits.MaxMemoryMB > 0 || limits.MaxCPUSeconds > 0 {
+		log.Println("Preview resource limits are not supported on windows")
+	}
+	return command
+}
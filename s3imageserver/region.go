@@ -0,0 +1,235 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type RegionMode int
+
+const (
+	RegionPixelate RegionMode = iota
+	RegionBlur
+)
+
+// The most regions a single request may redact
+const maxRegions = 32
+
+// A rectangle of the source image to redact, in pixels or, when Percent is set, in percentages of the source size
+type Region struct {
+	Mode    RegionMode
+	X, Y    float64
+	Width   float64
+	Height  float64
+	Percent bool
+}
+
+func (r Region) String() string {
+	unit := ""
+	if r.Percent {
+		unit = "%"
+	}
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) + unit }
+	return strings.Join([]string{format(r.X), format(r.Y), format(r.Width), format(r.Height)}, ",")
+}
+
+// The regions to pixelate and blur of a request. Any malformed rectangle, or more than maxRegions of them, is an
+// error, as redacting only some of them would serve what was meant to be hidden.
+func requestRegions(query url.Values) ([]Region, error) {
+	pixelate, err := parseRegions(query["rp"], RegionPixelate)
+	if err != nil {
+		return nil, err
+	}
+	blur, err := parseRegions(query["rb"], RegionBlur)
+	if err != nil {
+		return nil, err
+	}
+	regions := append(pixelate, blur...)
+	if len(regions) > maxRegions {
+		return nil, errors.Errorf("%v regions, at most %v are allowed", len(regions), maxRegions)
+	}
+	return regions, nil
+}
+
+// Parses rectangles given as x,y,w,h, separated by ; or in repeated parameters. Values ending in % are percentages
+// of the source size.
+func parseRegions(values []string, mode RegionMode) ([]Region, error) {
+	var regions []Region
+	for _, value := range values {
+		for _, rect := range strings.Split(value, ";") {
+			region, err := parseRegion(rect, mode)
+			if err != nil {
+				return nil, err
+			}
+			regions = append(regions, region)
+		}
+	}
+	return regions, nil
+}
+
+func parseRegion(rect string, mode RegionMode) (Region, error) {
+	parts := strings.Split(rect, ",")
+	if len(parts) != 4 {
+		return Region{}, errors.Errorf("region %v should be x,y,w,h", rect)
+	}
+	region := Region{Mode: mode, Percent: strings.HasSuffix(strings.TrimSpace(parts[0]), "%")}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		//a rectangle is in pixels or in percentages, a mix would redact some other area than the one meant
+		if strings.HasSuffix(part, "%") != region.Percent {
+			return Region{}, errors.Errorf("region %v mixes pixels and percentages", rect)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return Region{}, errors.Errorf("region %v has an invalid value", rect)
+		}
+		values[i] = v
+	}
+	region.X, region.Y, region.Width, region.Height = values[0], values[1], values[2], values[3]
+	if region.Width == 0 || region.Height == 0 {
+		return Region{}, errors.Errorf("region %v is empty", rect)
+	}
+	return region, nil
+}
+
+func regionsQuery(regions []Region, mode RegionMode) string {
+	var rects []string
+	for _, region := range regions {
+		if region.Mode == mode {
+			rects = append(rects, region.String())
+		}
+	}
+	return strings.Join(rects, ";")
+}
+
+// The rectangle in source pixels
+func (r Region) sourceRect(inWidth, inHeight int) image.Rectangle {
+	x, y, w, h := r.X, r.Y, r.Width, r.Height
+	if r.Percent {
+		x, w = x*float64(inWidth)/100, w*float64(inWidth)/100
+		y, h = y*float64(inHeight)/100, h*float64(inHeight)/100
+	}
+	return image.Rect(int(math.Floor(x)), int(math.Floor(y)), int(math.Ceil(x+w)), int(math.Ceil(y+h)))
+}
+
+// Mirrors the size calculations of vips.Resize, returning the scale applied to the source and the offset of the
+// centre crop in the scaled image
+func resizeGeometry(inWidth, inHeight int, s *FormatSettings) (float64, image.Point) {
+	width, height := s.Width, s.Height
+	if !s.Enlarge {
+		if inWidth < width {
+			width = inWidth
+		}
+		if inHeight < height {
+			height = inHeight
+		}
+	}
+	if s.WidthMissing && width > 0 {
+		width = 0
+	} else if s.HeightMissing && height > 0 {
+		height = 0
+	}
+
+	factor := 1.0
+	switch {
+	case width > 0 && height > 0:
+		xf := float64(inWidth) / float64(width)
+		yf := float64(inHeight) / float64(height)
+		if s.Crop {
+			factor = math.Min(xf, yf)
+		} else {
+			factor = math.Max(xf, yf)
+		}
+	case width > 0:
+		factor = float64(inWidth) / float64(width)
+		height = int(math.Floor(float64(inHeight) / factor))
+	case height > 0:
+		factor = float64(inHeight) / float64(height)
+		width = int(math.Floor(float64(inWidth) / factor))
+	default:
+		width, height = inWidth, inHeight
+	}
+
+	scale := 1 / factor
+	offset := image.Point{}
+	if s.Crop {
+		affinedWidth := int(math.Round(float64(inWidth) * scale))
+		affinedHeight := int(math.Round(float64(inHeight) * scale))
+		if affinedWidth > width {
+			offset.X = (affinedWidth - width + 1) / 2
+		}
+		if affinedHeight > height {
+			offset.Y = (affinedHeight - height + 1) / 2
+		}
+	}
+	return scale, offset
+}
+
+func mapRect(rect image.Rectangle, scale float64, offset image.Point) image.Rectangle {
+	return image.Rect(
+		int(math.Floor(float64(rect.Min.X)*scale)),
+		int(math.Floor(float64(rect.Min.Y)*scale)),
+		int(math.Ceil(float64(rect.Max.X)*scale)),
+		int(math.Ceil(float64(rect.Max.Y)*scale)),
+	).Sub(offset)
+}
+
+// Redacts the regions in place, mapped through the resize when the image was already resized
+func redactRegions(dst *image.NRGBA, regions []Region, inWidth, inHeight int, scale float64, offset image.Point) {
+	for _, region := range regions {
+		rect := mapRect(region.sourceRect(inWidth, inHeight), scale, offset).Add(dst.Bounds().Min).Intersect(dst.Bounds())
+		if rect.Empty() {
+			continue
+		}
+		switch region.Mode {
+		case RegionBlur:
+			boxBlurRect(dst, rect, maxInt(2, minInt(rect.Dx(), rect.Dy())/6), 3)
+		default:
+			pixelateRect(dst, rect, maxInt(2, maxInt(rect.Dx(), rect.Dy())/10))
+		}
+	}
+}
+
+// Applies the regions to the source before resizing, used when the crop is chosen by feature detection and the
+// geometry cannot be known up front. The result is encoded as PNG so vips gets it without further loss.
+func redactSource(source []byte, regions []Region) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecode, "Failed to decode image for redaction: %v", err)
+	}
+	dst := toNRGBA(img)
+	redactRegions(dst, regions, dst.Bounds().Dx(), dst.Bounds().Dy(), 1, image.Point{})
+	out := &bytes.Buffer{}
+	err = png.Encode(out, dst)
+	return out.Bytes(), err
+}
+
+func sourceSize(source []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return 0, 0, errors.Wrapf(ErrDecode, "Failed to read image size for redaction: %v", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
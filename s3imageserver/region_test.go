@@ -0,0 +1,62 @@
+package s3imageserver
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestRegions(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  string
+	}{
+		{url.Values{"rp": {"120,40,80,80"}}, "120,40,80,80"},
+		{url.Values{"rp": {"10%,70%,30%,10%"}}, "10%,70%,30%,10%"},
+		{url.Values{"rp": {"1,2,3,4;5%,6%,7%,8%"}, "rb": {"9,10,11,12"}}, "1,2,3,4;5%,6%,7%,8%;9,10,11,12"},
+		{url.Values{"rp": {" 1 , 2 , 3 , 4 "}}, "1,2,3,4"},
+		{url.Values{"rp": {"10,10%,5,5"}}, ""},
+		{url.Values{"rp": {"10%,10,5,5"}}, ""},
+		{url.Values{"rp": {"1,2,3"}}, ""},
+		{url.Values{"rp": {"1,2,3,x"}}, ""},
+		{url.Values{"rp": {"1,2,-3,4"}}, ""},
+		{url.Values{"rp": {"1,2,NaN,4"}}, ""},
+		{url.Values{"rp": {"1,2,Inf,4"}}, ""},
+		{url.Values{"rp": {"1,2,0,4"}}, ""},
+		{url.Values{"rb": {"1,2,3,4;"}}, ""},
+		{url.Values{"rp": {strings.Repeat("1,1,1,1;", maxRegions) + "1,1,1,1"}}, ""},
+	}
+	for _, test := range tests {
+		regions, err := requestRegions(test.query)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%v: got %v, want an error", test.query, regions)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.query, err)
+			continue
+		}
+		var rects []string
+		for _, region := range regions {
+			rects = append(rects, region.String())
+		}
+		if got := strings.Join(rects, ";"); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCleanURLKeepsRegionSeparators(t *testing.T) {
+	r := httptest.NewRequest("GET", "/a.jpg?w=10?rp=1,2,3,4;5%,6%,7%,8%", nil)
+	cleanURL(r)
+	regions, err := requestRegions(r.URL.Query())
+	if err != nil || len(regions) != 2 {
+		t.Errorf("got %v, %v, want both regions of %v", regions, err, r.URL)
+	}
+	if r.URL.Query().Get("w") != "10" {
+		t.Errorf("w is lost from %v", r.URL)
+	}
+}
@@ -1,33 +1,262 @@
 package s3imageserver
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	previewDirPrefix      = "s3thumb-"
+	previewOutputName     = "preview.png"
+	previewStdoutName     = "stdout"
+	defaultPreviewTimeout = 60
+)
+
+// How a preview command hands back its image
+const (
+	// prints the path of the image it wrote
+	PreviewOutputPath = "path"
+	// writes the image itself to stdout
+	PreviewOutputStdout = "stdout"
+	// writes the image to {output}, or to {output} with an extension of its own
+	PreviewOutputFile = "file"
+)
+
+// Limits for the preview commands of a source
+type PreviewLimits struct {
+	// seconds a command may run, defaults to a minute
+	Timeout int `json:"timeout"`
+	// commands running at once, unlimited when 0
+	MaxConcurrent int `json:"max_concurrent"`
+	// seconds a render waits for one of the max_concurrent slots, defaults to timeout
+	QueueTimeout int `json:"queue_timeout"`
+	// address space and CPU time of each command, applied with ulimit
+	MaxMemoryMB   int `json:"max_memory_mb"`
+	MaxCPUSeconds int `json:"max_cpu_seconds"`
+}
+
+// Optionally implemented by renderers that stop rendering when ctx is done
+type ContextThumbnailRenderer interface {
+	RenderContext(context.Context, string, io.Reader) (io.ReadCloser, error)
+}
+
+// A preview command for files matching any of its content types or file name globs, e.g. video/* or *.docx. The
+// arguments may contain {input}, {output}, {page}, {width} and {time}, the input is appended when {input} is not used.
+type PreviewCommand struct {
+	ContentTypes []string `json:"content_types"`
+	Files        []string `json:"files"`
+	Command      []string `json:"command"`
+	// file when the arguments contain {output}, path otherwise
+	Output string `json:"output"`
+}
+
+// Picks the first of Commands matching the file, falling back to Command for files that are not images
 type PreviewGenerator struct {
-	Command []string
+	Command       []string
+	CommandOutput string
+	Commands      []PreviewCommand
+	Limits        PreviewLimits
+	slots         chan struct{}
+}
+
+func NewPreviewGenerator(command []string, commands []PreviewCommand, limits PreviewLimits) *PreviewGenerator {
+	pg := &PreviewGenerator{
+		Command:  command,
+		Commands: commands,
+		Limits:   limits,
+	}
+	if limits.MaxConcurrent > 0 {
+		pg.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return pg
 }
 
 func (pg *PreviewGenerator) Render(filename string, file io.Reader) (io.ReadCloser, error) {
-	tempPath := path.Join(os.TempDir(), filename)
-	log.Println("Temp file at", tempPath)
-	tempFile, err := os.Create(tempPath)
+	return pg.RenderContext(context.Background(), filename, file)
+}
+
+// Runs the command for the type of file on a copy of it in a private work directory, which is removed when the preview
+// is closed. Images vips can resize and no command is mapped to are passed through as they are, the preview then takes
+// over the file and closes it when it is closed.
+func (pg *PreviewGenerator) RenderContext(ctx context.Context, filename string, file io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReaderSize(file, sniffLength)
+	head, err := reader.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return nil, upstreamError(err, "Error reading "+filename)
+	}
+	contentType := sniffContentType(head, filename)
+	//only images vips can resize are passed through, TIFF, HEIC and the like still need a command
+	resizable := sniffFormat(head) != ""
+	command := pg.command(contentType, filename, resizable)
+	if command == nil {
+		if resizable {
+			closer, ok := file.(io.Closer)
+			if !ok {
+				closer = ioutil.NopCloser(nil)
+			}
+			return &passThroughPreview{Reader: reader, Closer: closer}, nil
+		}
+		return nil, errors.Wrapf(ErrUnsupportedFormat, "no preview command for %v of type %v", filename, contentType)
+	}
+	log.Println("Rendering", filename, "of type", contentType, "with", command.Command[0])
+
+	workDir, err := ioutil.TempDir("", previewDirPrefix)
 	if err != nil {
+		return nil, errors.Wrap(err, "Could not create preview directory")
+	}
+	preview, err := pg.render(ctx, command, workDir, filename, reader)
+	if err != nil {
+		removePreviewDir(workDir)
 		return nil, err
 	}
-	_, err = io.Copy(tempFile, file)
+	return preview, nil
+}
+
+// The first mapping matching the content type or the file name, or the default command for anything that cannot be
+// resized as it is
+func (pg *PreviewGenerator) command(contentType, filename string, resizable bool) *PreviewCommand {
+	name := strings.ToLower(filepath.Base(filename))
+	for i, mapping := range pg.Commands {
+		if len(mapping.Command) > 0 && (matchesAny(mapping.ContentTypes, contentType) || matchesAny(mapping.Files, name)) {
+			return &pg.Commands[i]
+		}
+	}
+	if len(pg.Command) == 0 || resizable {
+		return nil
+	}
+	return &PreviewCommand{Command: pg.Command, Output: pg.CommandOutput}
+}
+
+// The arguments with the placeholders filled in. A new slice, as concurrent renders share the command.
+func (c *PreviewCommand) args(input, output string, options PreviewOptions) []string {
+	replacer := strings.NewReplacer(
+		"{input}", input,
+		"{output}", output,
+		"{page}", strconv.Itoa(options.Page),
+		"{width}", strconv.Itoa(options.Width),
+		"{time}", options.seconds(),
+	)
+	args := make([]string, 0, len(c.Command)+1)
+	hasInput := false
+	for _, arg := range c.Command {
+		hasInput = hasInput || strings.Contains(arg, "{input}")
+		args = append(args, replacer.Replace(arg))
+	}
+	if !hasInput {
+		args = append(args, input)
+	}
+	return args
+}
+
+func (c *PreviewCommand) output() string {
+	if c.Output != "" {
+		return c.Output
+	}
+	for _, arg := range c.Command {
+		if strings.Contains(arg, "{output}") {
+			return PreviewOutputFile
+		}
+	}
+	return PreviewOutputPath
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Waits for a free slot when max_concurrent is set, the returned func gives it back
+func (pg *PreviewGenerator) acquire(ctx context.Context) (func(), error) {
+	if pg.slots == nil {
+		return func() {}, nil
+	}
+	wait := pg.Limits.QueueTimeout
+	if wait <= 0 {
+		wait = pg.timeout()
+	}
+	timer := time.NewTimer(time.Duration(wait) * time.Second)
+	defer timer.Stop()
+	select {
+	case pg.slots <- struct{}{}:
+		return func() { <-pg.slots }, nil
+	case <-timer.C:
+		return nil, errors.Wrapf(ErrBusy, "no preview slot free after %v seconds", wait)
+	case <-ctx.Done():
+		return nil, errors.Wrap(ErrRenderCancelled, "gave up waiting for a preview slot")
+	}
+}
+
+func (pg *PreviewGenerator) timeout() int {
+	if pg.Limits.Timeout <= 0 {
+		return defaultPreviewTimeout
+	}
+	return pg.Limits.Timeout
+}
+
+// Runs cmd in its own process group, killing the whole group when it times out or ctx is done
+func (pg *PreviewGenerator) run(ctx context.Context, cmd *exec.Cmd) error {
+	release, err := pg.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(time.Duration(pg.timeout()) * time.Second)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		killProcessGroup(cmd)
+		<-done
+		return errors.Wrapf(ErrRenderTimeout, "%v ran for more than %v seconds", cmd.Args[0], pg.timeout())
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return errors.Wrapf(ErrRenderCancelled, "%v was stopped", cmd.Args[0])
+	}
+}
+
+func (pg *PreviewGenerator) render(ctx context.Context, command *PreviewCommand, workDir, filename string, file io.Reader) (io.ReadCloser, error) {
+	//keep the name, commands often go by its extension, but never let it point out of the work directory
+	name := filepath.Base(filename)
+	if name == "." || name == string(filepath.Separator) {
+		name = "input"
+	}
+	tempPath := filepath.Join(workDir, name)
+	log.Println("Temp file at", tempPath)
+	tempFile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return nil, err
 	}
-	err = tempFile.Close()
+	_, err = io.Copy(tempFile, file)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -35,29 +264,91 @@ func (pg *PreviewGenerator) Render(filename string, file io.Reader) (io.ReadClos
 	stdOut := &bytes.Buffer{}
 	stdErr := &bytes.Buffer{}
 
-	command := make([]string, len(pg.Command))
-
-	// copy the slice as we are running a concurrent threads and Command is shared
-	copy(command, pg.Command)
-
-	cmd := exec.Command(command[0], append(command[1:], tempPath)...)
+	outputPath := filepath.Join(workDir, previewOutputName)
+	args := limitCommand(command.args(tempPath, outputPath, PreviewOptionsFrom(ctx)), pg.Limits)
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = stdOut
 	cmd.Stderr = stdErr
+	//commands writing to the working or temp directory end up in the work directory as well
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(), "TMPDIR="+workDir)
 
-	err = cmd.Run()
+	output := command.output()
+	stdoutPath := filepath.Join(workDir, previewStdoutName)
+	if output == PreviewOutputStdout {
+		//the image goes to a file rather than memory, it is read from there like any other preview
+		stdoutFile, err := os.OpenFile(stdoutPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer stdoutFile.Close()
+		cmd.Stdout = stdoutFile
+	}
+
+	err = pg.run(ctx, cmd)
+	if statusForError(err, 0) != 0 {
+		return nil, err
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, string(stdErr.Bytes()))
 	}
 
-	resultingImg := stdOut.String()
-	resultingImg = strings.TrimSpace(resultingImg)
+	var resultingImg string
+	switch output {
+	case PreviewOutputStdout:
+		resultingImg = stdoutPath
+	case PreviewOutputFile:
+		resultingImg = findPreviewOutput(outputPath)
+	default:
+		resultingImg = strings.TrimSpace(stdOut.String())
+		if !filepath.IsAbs(resultingImg) {
+			resultingImg = filepath.Join(workDir, resultingImg)
+		}
+	}
 	log.Println("thumbnail at", resultingImg)
 
 	thumbnail, err := os.Open(resultingImg)
 	if err != nil {
 		return nil, err
 	}
+	if !withinDir(workDir, resultingImg) {
+		log.Println("Preview command wrote", resultingImg, "outside of its work directory, it is not removed")
+	}
+
+	return &previewFile{File: thumbnail, workDir: workDir}, nil
+}
+
+// The output path, or what the command made of it when it added an extension of its own, like pdftoppm does
+func findPreviewOutput(outputPath string) string {
+	if _, err := os.Stat(outputPath); err == nil {
+		return outputPath
+	}
+	if matches, _ := filepath.Glob(outputPath + ".*"); len(matches) > 0 {
+		return matches[0]
+	}
+	return outputPath
+}
+
+// The rendered preview, closing it removes the work directory along with the input and the preview itself
+type previewFile struct {
+	*os.File
+	workDir string
+}
 
-	return thumbnail, nil
+func (f *previewFile) Close() error {
+	err := f.File.Close()
+	removePreviewDir(f.workDir)
+	return err
+}
 
+// An image handed on as it is. It is still being read from the file it came from, which it closes when it is closed.
+type passThroughPreview struct {
+	*bufio.Reader
+	io.Closer
+}
+
+func removePreviewDir(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Println("Could not remove preview directory", dir, err)
+	}
 }
@@ -0,0 +1,44 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPreviewGeneratorPassesOnlyResizableImagesThrough(t *testing.T) {
+	tests := []struct {
+		filename    string
+		head        []byte
+		passThrough bool
+	}{
+		{"photo.jpg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), true},
+		{"photo.png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), true},
+		{"photo.gif", []byte("GIF89a\x01\x00\x01\x00"), true},
+		{"photo.webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), true},
+		{"photo.tiff", []byte("II*\x00\x08\x00\x00\x00"), false},
+		{"photo.heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), false},
+		{"photo.bmp", []byte("BM\x36\x00\x00\x00\x00\x00\x00\x00\x36\x00"), false},
+		{"report.pdf", []byte("%PDF-1.4\n"), false},
+	}
+	withoutCommand := NewPreviewGenerator(nil, nil, PreviewLimits{})
+	withCommand := NewPreviewGenerator([]string{"render-preview"}, nil, PreviewLimits{})
+	for _, test := range tests {
+		preview, err := withoutCommand.Render(test.filename, bytes.NewReader(test.head))
+		_, passedThrough := preview.(*passThroughPreview)
+		if passedThrough != test.passThrough {
+			t.Errorf("%v: passed through %v, want %v", test.filename, passedThrough, test.passThrough)
+		}
+		if !test.passThrough && statusForError(err, 0) != 415 {
+			t.Errorf("%v without a command: got %v, want an unsupported format", test.filename, err)
+		}
+		if preview != nil {
+			preview.Close()
+		}
+
+		contentType := sniffContentType(test.head, test.filename)
+		command := withCommand.command(contentType, test.filename, sniffFormat(test.head) != "")
+		if (command == nil) != test.passThrough {
+			t.Errorf("%v of type %v: default command %v, want it used %v", test.filename, contentType, command, !test.passThrough)
+		}
+	}
+}
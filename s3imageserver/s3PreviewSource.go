@@ -1,25 +1,25 @@
 package s3imageserver
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/kr/s3"
 	"github.com/pkg/errors"
 )
 
 var s3PreviewSourceOnce sync.Once
 
 type S3PreviewConfig struct {
-	AWSAccess string   `json:"aws_access"`
-	AWSSecret string   `json:"aws_secret"`
-	Command   []string `json:"command"`
+	S3Config
+	PreviewLimits
+	// the default command, for files no entry of commands matches
+	Command       []string         `json:"command"`
+	CommandOutput string           `json:"command_output"`
+	Commands      []PreviewCommand `json:"commands"`
 }
 
 type s3PreviewSource struct {
@@ -39,48 +39,59 @@ func NewS3PreviewSource() func(config S3PreviewConfig) *s3PreviewSource {
 	})
 
 	return func(config S3PreviewConfig) *s3PreviewSource {
+		config.credentials = newCredentialChain(config.S3Config)
+		previewer := NewPreviewGenerator(config.Command, config.Commands, config.PreviewLimits)
+		previewer.CommandOutput = config.CommandOutput
 		return &s3PreviewSource{
 			S3PreviewConfig: config,
-			previewer:       &PreviewGenerator{config.Command},
+			previewer:       previewer,
 		}
 	}
 }
 
 func (s *s3PreviewSource) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *s3PreviewSource) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return readStream(s.OpenImage(context.Background(), path))
+}
+
+func (s *s3PreviewSource) OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error) {
 	parts := strings.Split(path, "/")
-	reqURL := fmt.Sprintf("https://%v.s3.amazonaws.com/%v", parts[1], strings.Join(parts[2:], "/"))
-	log.Println("aws request url ", reqURL)
-	req, err := http.NewRequest("GET", reqURL, nil)
+	resp, err := s.getObject(ctx, path)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not create request")
+		return nil, nil, err
 	}
-	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	req.Header.Set("X-Amz-Acl", "public-read")
-	s3.Sign(req, s3.Keys{
-		AccessKey: s.AWSAccess,
-		SecretKey: s.AWSSecret,
-	})
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to fetch")
+	var image io.ReadCloser
+	if renderer, ok := s.previewer.(ContextThumbnailRenderer); ok {
+		image, err = renderer.RenderContext(ctx, parts[len(parts)-1], resp.Body)
+	} else {
+		image, err = s.previewer.Render(parts[len(parts)-1], resp.Body)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("%v error while making request", resp.StatusCode)
+	//a passed through image is still reading the body and closes it itself
+	if _, ok := image.(*passThroughPreview); !ok {
+		defer resp.Body.Close()
+	}
+	if statusForError(err, 0) != 0 {
+		return nil, nil, errors.Wrap(err, "Failed to render thumbnail")
 	}
-
-	image, err := s.previewer.Render(parts[len(parts)-1], resp.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to render thumbnail")
+		return nil, nil, errors.Wrapf(ErrDecode, "Failed to render thumbnail: %v", err)
 	}
-	defer func() { _ = image.Close() }()
 
-	data, err := ioutil.ReadAll(image)
+	//the validators describe the source document, the preview is derived from it
+	source := metadataFromResponse(resp)
+	return image, &ImageMetadata{ETag: source.ETag, LastModified: source.LastModified}, nil
+}
 
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error reading Render from %v", req.URL)
-	}
+// Previews are rendered for the page and width of the request
+func (s *s3PreviewSource) UsesPreviewOptions() bool {
+	return true
+}
 
-	return data, nil
+func (s *s3PreviewSource) GetMetadata(path string) (*ImageMetadata, error) {
+	return s.headObject(path)
 }
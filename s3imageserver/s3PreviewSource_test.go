@@ -0,0 +1,61 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testPNG(t *testing.T, size int) []byte {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestS3PreviewSourcePassesImagesThrough(t *testing.T) {
+	body := testPNG(t, 64)
+	if len(body) <= sniffLength {
+		t.Fatalf("test image is %v bytes, it should not fit in the sniffed head", len(body))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/image.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	useSSL := false
+	source := NewS3PreviewSource()(S3PreviewConfig{S3Config: S3Config{
+		AWSAccess: "AKIDEXAMPLE",
+		AWSSecret: "secret",
+		Endpoint:  server.URL,
+		PathStyle: true,
+		UseSSL:    &useSSL,
+	}})
+
+	data, meta, err := source.GetImageWithMetadata("/bucket/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Errorf("got %v bytes, want the %v bytes of the source image", len(data), len(body))
+	}
+	if meta.ETag != `"abc"` {
+		t.Errorf("ETag = %v, want \"abc\"", meta.ETag)
+	}
+
+	if _, err := source.GetImage("/bucket/missing.png"); !IsNotFound(err) {
+		t.Errorf("missing object: got %v, want not found", err)
+	}
+}
@@ -1,23 +1,35 @@
 package s3imageserver
 
 import (
-	"fmt"
-	"io/ioutil"
+	"context"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/kr/s3"
 	"github.com/pkg/errors"
 )
 
 type S3Config struct {
 	AWSAccess string `json:"aws_access"`
 	AWSSecret string `json:"aws_secret"`
+	Region    string `json:"region"`
+	// host[:port] of an S3 compatible store, a scheme in front of it overrides use_ssl
+	Endpoint  string `json:"endpoint"`
+	PathStyle bool   `json:"path_style"`
+	UseSSL    *bool  `json:"use_ssl"`
+	// profile of the shared credentials file, defaults to AWS_PROFILE or default
+	Profile string `json:"profile"`
+
+	// set up by the source constructors
+	credentials *credentialChain
 }
 
+const defaultS3Region = "us-east-1"
+
 type s3source struct {
 	S3Config
 }
@@ -30,38 +42,128 @@ func NewS3Source(config S3Config) *s3source {
 		http.DefaultClient.Timeout = 15 * time.Second
 	})
 
+	config.credentials = newCredentialChain(config)
 	return &s3source{
 		S3Config: config,
 	}
 }
 
 func (s *s3source) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *s3source) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return readStream(s.OpenImage(context.Background(), path))
+}
+
+func (s *s3source) OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error) {
+	resp, err := s.getObject(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, metadataFromResponse(resp), nil
+}
+
+func (s *s3source) GetMetadata(path string) (*ImageMetadata, error) {
+	return s.headObject(path)
+}
+
+// Builds a SigV4 signed request for /bucket/key, virtual host style unless path_style is set
+func (c S3Config) newRequest(method, path string) (*http.Request, error) {
 	parts := strings.Split(path, "/")
-	reqURL := fmt.Sprintf("https://%v.s3.amazonaws.com/%v", parts[1], strings.Join(parts[2:], "/"))
+	if len(parts) < 3 || parts[1] == "" {
+		return nil, errors.Wrapf(ErrNotFound, "path %v should be /bucket/key", path)
+	}
+	bucket, key := parts[1], strings.Join(parts[2:], "/")
+
+	scheme := "https"
+	if c.UseSSL != nil && !*c.UseSSL {
+		scheme = "http"
+	}
+	endpoint := c.Endpoint
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		scheme, endpoint = endpoint[:i], endpoint[i+3:]
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	region := c.region()
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+		if region != defaultS3Region {
+			endpoint = "s3." + region + ".amazonaws.com"
+		}
+	}
+
+	reqURL := &url.URL{Scheme: scheme}
+	if c.PathStyle {
+		reqURL.Host = endpoint
+		reqURL.Path = "/" + bucket + "/" + key
+	} else {
+		reqURL.Host = bucket + "." + endpoint
+		reqURL.Path = "/" + key
+	}
+	reqURL.RawPath = awsURIEncode(reqURL.Path, false)
 	log.Println("aws request url ", reqURL)
-	req, reqErr := http.NewRequest("GET", reqURL, nil)
-	if reqErr != nil {
-		return nil, errors.Wrap(reqErr, "Could not create request")
-	}
-	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	req.Header.Set("X-Amz-Acl", "public-read")
-	s3.Sign(req, s3.Keys{
-		AccessKey: s.S3Config.AWSAccess,
-		SecretKey: s.S3Config.AWSSecret,
-	})
-	resp, err := http.DefaultClient.Do(req)
+
+	req, err := http.NewRequest(method, reqURL.String(), nil)
 	if err != nil {
-		return nil, errors.Wrap(reqErr, "Failed to fetch")
+		return nil, err
+	}
+	creds, err := c.credentials.get()
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, creds, region, time.Now())
+	return req, nil
+}
+
+func (c S3Config) region() string {
+	if c.Region == "" {
+		return defaultS3Region
+	}
+	return c.Region
+}
+
+// The response of a GET for the object, its body is left for the caller to close
+func (c S3Config) getObject(ctx context.Context, path string) (*http.Response, error) {
+	req, err := c.newRequest("GET", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create request")
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, upstreamError(err, "Failed to fetch")
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("%v error while making request", resp.StatusCode)
+		resp.Body.Close()
+		return nil, upstreamStatusError(resp.StatusCode)
 	}
-	data, err := ioutil.ReadAll(resp.Body)
+	return resp, nil
+}
 
+func (c S3Config) headObject(path string) (*ImageMetadata, error) {
+	req, err := c.newRequest("HEAD", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create request")
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error reading response body from %v", req.URL)
+		return nil, upstreamError(err, "Failed to fetch metadata")
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, upstreamStatusError(resp.StatusCode)
+	}
+	return metadataFromResponse(resp), nil
+}
 
-	return data, nil
+func metadataFromResponse(resp *http.Response) *ImageMetadata {
+	meta := &ImageMetadata{ETag: resp.Header.Get("ETag"), ContentType: resp.Header.Get("Content-Type")}
+	if resp.ContentLength > 0 {
+		meta.Size = resp.ContentLength
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		meta.LastModified = lastModified
+	}
+	return meta
 }
@@ -1,6 +1,7 @@
 package s3imageserver
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
@@ -18,17 +19,20 @@ import (
 )
 
 type Config struct {
-	SourceConfigs   map[string]json.RawMessage `json:"sources"`
-	Routes          []HandlerConfig            `json:"routes"`
-	HTTPPort        int                        `json:"http_port"`
-	HTTPSEnabled    bool                       `json:"https_enabled"`
-	HTTPSStrict     bool                       `json:"https_strict"`
-	HTTPSPort       int                        `json:"https_port"`
-	HTTPSCert       string                     `json:"https_cert"`
-	HTTPSKey        string                     `json:"https_key"`
-	Database        string                     `json:"database"`
-	CallbackEnabled bool                       `json:"callback_enabled"`
-	Defaults        *FormatDefaults            `json:"defaults"`
+	SourceConfigs          map[string]json.RawMessage `json:"sources"`
+	Routes                 []HandlerConfig            `json:"routes"`
+	HTTPPort               int                        `json:"http_port"`
+	HTTPSEnabled           bool                       `json:"https_enabled"`
+	HTTPSStrict            bool                       `json:"https_strict"`
+	HTTPSPort              int                        `json:"https_port"`
+	HTTPSCert              string                     `json:"https_cert"`
+	HTTPSKey               string                     `json:"https_key"`
+	Database               string                     `json:"database"`
+	CallbackEnabled        bool                       `json:"callback_enabled"`
+	Defaults               *FormatDefaults            `json:"defaults"`
+	MemoryCacheBytes       int64                      `json:"memory_cache_bytes"`
+	SourceMemoryCacheBytes int64                      `json:"source_memory_cache_bytes"`
+	AdminToken             string                     `json:"admin_token"`
 }
 
 type HandlerConfig struct {
@@ -37,8 +41,21 @@ type HandlerConfig struct {
 	ErrorImage           string          `json:"error_image"`
 	Allowed              []string        `json:"allowed_formats"`
 	VerificationRequired *bool           `json:"verification_required"`
+	VerificationCookie   string          `json:"verification_cookie"`
+	SigningKey           string          `json:"signing_key"`
+	SigningKeys          []string        `json:"signing_keys"`
+	CacheControl         string          `json:"cache_control"`
+	AutoFormat           bool            `json:"auto_format"`
+	CacheEnabled         bool            `json:"cache_enabled"`
+	CachePath            string          `json:"cache_path"`
+	CacheTime            *int            `json:"cache_time"`
+	CacheMaxBytes        int64           `json:"cache_max_bytes"`
+	Cache                DerivativeCache `json:"-"`
 	Defaults             *FormatDefaults `json:"defaults"`
 	Rewrite              *RegexRewrite   `json:"rewrite"`
+
+	// shared by the routes of a server, so routes on the same source fetch an object once
+	fetches *flightGroup
 }
 
 type FormatDefaults struct {
@@ -49,6 +66,7 @@ type FormatDefaults struct {
 	DefaultFeatureCrop *bool  `json:"default_feature_crop"`
 	WifiQuality        *int   `json:"wifi_quality"`
 	DefaultImageFormat string `json:"default_format"`
+	CacheMaxAge        *int   `json:"cache_max_age"`
 }
 
 type RegexRewrite struct {
@@ -63,6 +81,9 @@ var Sources = &SourceMap{}
 func init() {
 	Sources.AddSource("s3", NewS3Source)
 	Sources.AddSource("s3Thumb", NewS3PreviewSource())
+	Sources.AddSource("file", NewFileSource)
+	Sources.AddSource("http", NewHTTPSource)
+	Sources.AddSource("chain", NewChainSource)
 }
 
 func Run(verify HandleVerification) (done *sync.WaitGroup) {
@@ -89,6 +110,16 @@ func Run(verify HandleVerification) (done *sync.WaitGroup) {
 		log.Println("Port:", conf.HTTPPort)
 	}
 
+	var memory, sourceMemory *memoryCache
+	if conf.MemoryCacheBytes > 0 {
+		memory = newMemoryCache(conf.MemoryCacheBytes)
+	}
+	if conf.SourceMemoryCacheBytes > 0 {
+		sourceMemory = newMemoryCache(conf.SourceMemoryCacheBytes)
+	}
+
+	var purgeable []PurgeableCache
+	fetches := &flightGroup{}
 	r := http.NewServeMux()
 	for _, handler := range conf.Routes {
 		log.Println("Adding handler", handler.Route)
@@ -101,12 +132,35 @@ func Run(verify HandleVerification) (done *sync.WaitGroup) {
 			log.Println("Cannot start handler:", handler.Route, "with source", handler.Source, "due to", err)
 			continue
 		}
+		if cs, ok := imgSource.(compositeSource); ok {
+			if err := cs.resolveSources(conf.SourceConfigs, 0); err != nil {
+				log.Println("Cannot start handler:", handler.Route, "with source", handler.Source, "due to", err)
+				continue
+			}
+		}
+		if sourceMemory != nil {
+			imgSource = newMemoryCachedSource(imgSource, sourceMemory, handler.Source)
+		}
+		handler.Cache = newRouteCache(handler)
+		handler.fetches = fetches
+		if memory != nil {
+			handler.Cache = newMemoryTier(memory, handler.Route, handler.Cache)
+		}
+		if pc, ok := handler.Cache.(PurgeableCache); ok {
+			purgeable = append(purgeable, pc)
+		}
 
 		r.HandleFunc(handler.Route, Handle(imgSource, handler, verify))
 	}
 	r.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 	})
+	if conf.AdminToken != "" {
+		r.HandleFunc("/admin/cache", purgeHandler(conf.AdminToken, purgeable, sourceMemory))
+		if memory != nil || sourceMemory != nil {
+			r.HandleFunc("/admin/stats", statsHandler(conf.AdminToken, memory, sourceMemory))
+		}
+	}
 
 	if conf.validateHTTPS() {
 		config := tls.Config{
@@ -168,67 +222,190 @@ func Handle(source ImageSource, config HandlerConfig, verify HandleVerification)
 		log.Println("rewrite is nil for route", config.Route)
 	}
 
+	signingKeys := config.signingKeys()
+	allowed := newFormatSet(config.Allowed)
+	caching := newCachePolicy(config)
+	cache := newRouteCache(config)
+	//concurrent requests for the same object share one fetch, and for the same derivative one resize
+	fetches := config.fetches
+	if fetches == nil {
+		fetches = &flightGroup{}
+	}
+	renders := &flightGroup{}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println(config.Route, "Handeling", r)
+		log.Println(config.Route, "Handeling", r.Method, loggableURL(r))
 		//TODO:: This is dodgy AF. it replaces ? with &, impling we get malformed query params
 		cleanURL(r)
+		//signatures cover the path the client asked for
+		requestPath := r.URL.Path
 		if match != nil {
 			r.URL.Path = match.ReplaceAllString(r.URL.Path, config.Rewrite.Replace)
 		}
 
+		if status := verifyRequest(r, config, verify); status != http.StatusOK {
+			log.Println(config.Route, "verification failed with status", status, r.URL.Path)
+			w.WriteHeader(status)
+			return
+		}
+
+		if !verifySignature(requestPath, r.URL.Query(), signingKeys) {
+			log.Println(config.Route, "invalid signature", requestPath)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		//a parameter net/url cannot parse is left out of the query, regions and all
+		if _, err := url.ParseQuery(r.URL.RawQuery); err != nil {
+			log.Println(config.Route, "invalid query", err)
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		if _, err := requestRegions(r.URL.Query()); err != nil {
+			log.Println(config.Route, "invalid regions", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		//Get formatting settings
 		formatting := GetFormatSettings(r, config.Defaults)
+		if !allowed.allowsPath(r.URL.Path) {
+			log.Println(config.Route, "input format not allowed", r.URL.Path)
+			writeError(w, config, formatting, http.StatusUnsupportedMediaType)
+			return
+		}
+		outputFormat, ok := allowed.outputFormat(r.URL.Query().Get("f"), formatting.OutputFormat)
+		if !ok {
+			log.Println(config.Route, "output format not allowed", r.URL.Query().Get("f"))
+			http.Error(w, "output format not allowed", http.StatusBadRequest)
+			return
+		}
+		formatting.OutputFormat = outputFormat
+		//pages and positions only matter to sources rendering previews, others would just fill the cache with copies
+		if !usesPreviewOptions(source) {
+			formatting.Page, formatting.Timestamp = 0, 0
+		}
 
-		//GET image from source
-		img, err := source.GetImage(r.URL.Path)
+		//Without an explicit f the Accept header picks the format, which might have to wait for the image to check for alpha
+		var vary []string
+		negotiated := true
+		autoFormat := config.AutoFormat && r.URL.Query().Get("f") == ""
+		if autoFormat {
+			vary = append(vary, "Accept")
+			if outputFormat, negotiated = negotiateFormat(r.Header.Get("Accept"), allowed, nil); negotiated {
+				formatting.OutputFormat = outputFormat
+			}
+		}
 
-		if err != nil {
-			log.Printf("GetImage failed for %v with error %+v", r.URL.String(), err)
-
-			if len(config.ErrorImage) > 0 {
-				//Missing img
-				img, err := ErrorImage(config.ErrorImage, formatting)
-				if err != nil {
-					log.Printf("Error getting error img %+v", err)
-					w.WriteHeader(http.StatusInternalServerError)
+		variant := formatting.canonical()
+		if !negotiated {
+			variant += "&f=auto"
+		}
+		if cache != nil {
+			if cached, ok := cache.Get(r.URL.Path, variant); ok {
+				if notModified(r, cached.ETag, cached.LastModified) {
+					writeNotModified(w, caching, cached.ETag, cached.LastModified, vary...)
 					return
 				}
-				_, err = w.Write(img)
-				if err != nil {
-					log.Printf("Error writing result %+v", err)
+				writeImage(w, caching, cached, vary...)
+				return
+			}
+		}
+
+		//Answer conditional requests from the metadata alone when the source can look it up, skipping the fetch and resize
+		if ms, ok := source.(MetadataSource); ok && negotiated && hasConditionalHeaders(r) {
+			if meta, err := ms.GetMetadata(r.URL.Path); err == nil {
+				etag := derivativeETag(meta, nil, formatting)
+				if notModified(r, etag, meta.LastModified) {
+					writeNotModified(w, caching, etag, meta.LastModified, vary...)
+					return
 				}
-			} else {
-				w.WriteHeader(http.StatusNotFound)
 			}
+		}
 
+		//GET image from source
+		previewOptions := PreviewOptions{Page: formatting.Page, Width: formatting.Width, Time: formatting.Timestamp}
+		fetchKey := config.Source + ":" + sourceKey(WithPreviewOptions(r.Context(), previewOptions), source, r.URL.Path)
+		fetched, err := fetches.doContext(r.Context(), fetchKey, func(ctx context.Context) (interface{}, error) {
+			img, meta, err := getImageWithMetadata(WithPreviewOptions(ctx, previewOptions), source, r.URL.Path)
+			return &sourceImage{data: img, meta: meta}, err
+		})
+
+		if err != nil && r.Context().Err() != nil {
+			log.Println(config.Route, "client went away while fetching", r.URL.Path, statusForError(err, statusClientClosedRequest))
+			return
+		}
+		if err != nil {
+			log.Printf("GetImage failed for %v with error %+v", loggableURL(r), err)
+			writeError(w, config, formatting, statusForError(err, http.StatusBadGateway))
 			return
 		}
 
+		img, meta := fetched.(*sourceImage).data, fetched.(*sourceImage).meta
 		log.Println("Image with size", len(img), r.URL.Path)
 
+		if allowed != nil && !allowed.allows(sniffFormat(img)) {
+			log.Println(config.Route, "input format not allowed", r.URL.Path)
+			writeError(w, config, formatting, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if !negotiated {
+			formatting.OutputFormat, _ = negotiateFormat(r.Header.Get("Accept"), allowed, img)
+		}
+
+		etag := derivativeETag(meta, img, formatting)
+		if notModified(r, etag, meta.LastModified) {
+			writeNotModified(w, caching, etag, meta.LastModified, vary...)
+			return
+		}
+
 		//Resize and/or crop + Present in encoding
-		resultImg, err := ResizeCrop(img, formatting)
-		if err != nil {
-			log.Printf("ResizeCrop failed for %v with error %+v", r.URL.String(), err)
-			//Mssing img
-			img, err := ErrorImage(config.ErrorImage, formatting)
+		rendered, err := renders.do(r.URL.Path+"\x00"+variant+"\x00"+etag, func() (interface{}, error) {
+			resultImg, err := ResizeCrop(img, formatting)
 			if err != nil {
-				log.Printf("Error getting error img %+v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+				return nil, err
 			}
-			_, err = w.Write(img)
-			if err != nil {
-				log.Printf("Error writing result %+v", err)
+			result := &CachedImage{
+				Data:         resultImg,
+				Format:       formatting.OutputFormat,
+				ETag:         etag,
+				LastModified: meta.LastModified,
+			}
+			if cache != nil {
+				if err := cache.Set(r.URL.Path, variant, result); err != nil {
+					log.Printf("Error caching result for %v %+v", loggableURL(r), err)
+				}
 			}
+			return result, nil
+		})
+		if err != nil {
+			log.Printf("ResizeCrop failed for %v with error %+v", loggableURL(r), err)
+			writeError(w, config, formatting, statusForError(err, http.StatusInternalServerError))
 			return
 		}
 
-		w.Header().Set("Content-Length", strconv.Itoa(len(resultImg)))
-		_, err = w.Write(resultImg)
-		if err != nil {
-			log.Printf("Error writing result %+v", err)
-		}
+		writeImage(w, caching, rendered.(*CachedImage), vary...)
+	}
+}
+
+// Responds with status, showing the error image of the route when it has one
+func writeError(w http.ResponseWriter, config HandlerConfig, formatting *FormatSettings, status int) {
+	setNoCacheHeaders(w)
+	if len(config.ErrorImage) == 0 {
+		w.WriteHeader(status)
+		return
+	}
+	img, err := ErrorImage(config.ErrorImage, formatting)
+	if err != nil {
+		log.Printf("Error getting error img %+v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setContentHeaders(w, formatting.OutputFormat, len(img))
+	w.WriteHeader(status)
+	if _, err = w.Write(img); err != nil {
+		log.Printf("Error writing result %+v", err)
 	}
 }
 
@@ -243,16 +420,34 @@ func ErrorImage(url string, formatting *FormatSettings) ([]byte, error) {
 	return nil, nil
 }
 
+// Turns stray ? into & and escapes ; and lone %, like the ; separating regions and the % of their percentages, which
+// would otherwise make net/url drop the whole parameter
 func cleanURL(r *http.Request) {
 	query := strings.SplitN(r.URL.String(), "?", 2)
 	queryString := query[0]
 	if len(query) > 1 {
-		queryString = queryString + "?" + strings.Replace(query[1], "?", "&", -1)
+		queryString = queryString + "?" + escapeQuery(strings.NewReplacer("?", "&", ";", "%3B").Replace(query[1]))
 	}
 	url, _ := url.ParseRequestURI(queryString)
 	r.URL = url
 }
 
+func escapeQuery(query string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(query); i++ {
+		if query[i] == '%' && (i+2 >= len(query) || !isHex(query[i+1]) || !isHex(query[i+2])) {
+			escaped.WriteString("%25")
+			continue
+		}
+		escaped.WriteByte(query[i])
+	}
+	return escaped.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
 func (c *Config) validateHTTPS() bool {
 	if c.HTTPSEnabled && c.HTTPSKey != "" && c.HTTPSCert != "" && c.HTTPSPort != 0 && c.HTTPSPort != c.HTTPPort {
 		return true
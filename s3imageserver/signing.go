@@ -0,0 +1,128 @@
+package s3imageserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const signatureParam = "s"
+
+// Query parameters that change the rendered image and are therefore covered by the signature
+var transformationParams = []string{"w", "h", "c", "fc", "e", "i", "p", "q", "b", "px", "f", "rp", "rb", "bx", "gb", "br", "ct", "fl", "page", "ts"}
+
+// SignURL returns path with the query parameters for settings and a signature made with key. Enlarge and Interlaced
+// default to true on the server, settings built from scratch should set them to keep that.
+func SignURL(path string, settings FormatSettings, key string) string {
+	query := settingsQuery(settings)
+	query.Set(signatureParam, signature(path, query, key))
+	return path + "?" + query.Encode()
+}
+
+func settingsQuery(settings FormatSettings) url.Values {
+	query := url.Values{}
+	if !settings.WidthMissing {
+		query.Set("w", strconv.Itoa(settings.Width))
+	}
+	if !settings.HeightMissing {
+		query.Set("h", strconv.Itoa(settings.Height))
+	}
+	query.Set("c", strconv.FormatBool(settings.Crop))
+	query.Set("fc", strconv.FormatBool(settings.FeatureCrop))
+	//enlarging and interlacing are on unless the query turns them off
+	if !settings.Enlarge {
+		query.Set("e", "false")
+	}
+	if !settings.Interlaced {
+		query.Set("i", "false")
+	}
+	if settings.Quality > 0 {
+		query.Set("q", strconv.Itoa(settings.Quality))
+	}
+	if settings.BlurAmount > 0 {
+		query.Set("b", strconv.FormatFloat(float64(settings.BlurAmount), 'f', -1, 32))
+	}
+	if settings.Pixelation > 0 {
+		query.Set("px", strconv.Itoa(settings.Pixelation))
+	}
+	if regions := regionsQuery(settings.Regions, RegionPixelate); regions != "" {
+		query.Set("rp", regions)
+	}
+	if regions := regionsQuery(settings.Regions, RegionBlur); regions != "" {
+		query.Set("rb", regions)
+	}
+	if settings.BoxBlur > 0 {
+		query.Set("bx", strconv.Itoa(settings.BoxBlur))
+	}
+	if settings.GaussianBlur > 0 {
+		query.Set("gb", strconv.FormatFloat(float64(settings.GaussianBlur), 'f', -1, 32))
+	}
+	if settings.Brightness != 0 {
+		query.Set("br", strconv.Itoa(settings.Brightness))
+	}
+	if settings.Contrast != 0 {
+		query.Set("ct", strconv.Itoa(settings.Contrast))
+	}
+	if filters := filterList(settings); filters != "" {
+		query.Set("fl", filters)
+	}
+	if settings.Page > 1 {
+		query.Set("page", strconv.Itoa(settings.Page))
+	}
+	if settings.Timestamp > 0 {
+		query.Set("ts", strconv.FormatFloat(settings.Timestamp.Seconds(), 'f', -1, 64))
+	}
+	if name, ok := friendlyTypeNames[settings.OutputFormat]; ok {
+		query.Set("f", name)
+	}
+	return query
+}
+
+// Builds the string that gets signed, only transformation parameters are included and they are sorted by name
+func canonicalRequest(path string, query url.Values) string {
+	params := make([]string, 0, len(transformationParams))
+	for _, name := range transformationParams {
+		if values, ok := query[name]; ok {
+			for _, value := range values {
+				params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(value))
+			}
+		}
+	}
+	sort.Strings(params)
+	return path + "?" + strings.Join(params, "&")
+}
+
+func signature(path string, query url.Values, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(canonicalRequest(path, query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the s query parameter against every configured key, so keys can be rotated. The path is the one the client
+// asked for, before any rewrite.
+func verifySignature(path string, query url.Values, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	sig := query.Get(signatureParam)
+	if sig == "" {
+		return false
+	}
+	for _, key := range keys {
+		if hmac.Equal([]byte(sig), []byte(signature(path, query, key))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c HandlerConfig) signingKeys() []string {
+	if c.SigningKey == "" {
+		return c.SigningKeys
+	}
+	return append([]string{c.SigningKey}, c.SigningKeys...)
+}
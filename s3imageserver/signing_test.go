@@ -0,0 +1,69 @@
+package s3imageserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestSignURLOmitsServerDefaults(t *testing.T) {
+	tests := []struct {
+		settings FormatSettings
+		want     string
+	}{
+		{FormatSettings{Width: 300, HeightMissing: true, Enlarge: true, Interlaced: true}, "/a.jpg?c=false&fc=false&w=300"},
+		{FormatSettings{Width: 300, HeightMissing: true, Interlaced: true}, "/a.jpg?c=false&e=false&fc=false&w=300"},
+		{FormatSettings{Width: 300, Height: 200, Crop: true, Enlarge: true}, "/a.jpg?c=true&fc=false&h=200&i=false&w=300"},
+	}
+	for _, test := range tests {
+		signed, err := url.Parse(SignURL("/a.jpg", test.settings, "key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := signed.Query()
+		query.Del(signatureParam)
+		if got := signed.Path + "?" + query.Encode(); got != test.want {
+			t.Errorf("SignURL(%+v) = %v, want %v", test.settings, got, test.want)
+		}
+	}
+}
+
+func TestSignedURLOnRewrittenRoute(t *testing.T) {
+	width, height, quality := 100, 100, 80
+	config := HandlerConfig{
+		Route:      "/img/",
+		SigningKey: "key",
+		Rewrite:    &RegexRewrite{Match: "^/img/", Replace: "/"},
+		Defaults:   &FormatDefaults{DefaultWidth: &width, DefaultHeight: &height, DefaultQuality: &quality, WifiQuality: &quality},
+	}
+	root, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	handler := Handle(NewFileSource(FileConfig{Root: root}), config, nil)
+	settings := FormatSettings{Width: 300, Height: 200, Crop: true, Enlarge: true, Interlaced: true}
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		//the file does not exist, a 404 means the signature was accepted
+		{"signed request path", SignURL("/img/missing.jpg", settings, "key"), http.StatusNotFound},
+		{"signed rewritten path", "/img" + SignURL("/missing.jpg", settings, "key"), http.StatusForbidden},
+		{"other key", SignURL("/img/missing.jpg", settings, "other"), http.StatusForbidden},
+		{"changed width", SignURL("/img/missing.jpg", settings, "key") + "&w=400", http.StatusForbidden},
+		{"unsigned", "/img/missing.jpg?w=300", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("GET", test.url, nil))
+		if recorder.Code != test.want {
+			t.Errorf("%v: %v got status %v, want %v", test.name, test.url, recorder.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package s3imageserver
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// How many bytes http.DetectContentType looks at
+const sniffLength = 512
+
+// Content types of the zip based office formats, which sniff as plain zip files
+var officeTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+}
+
+// The legacy office formats share the OLE compound file container
+var legacyOfficeTypes = map[string]string{
+	".doc": "application/msword",
+	".xls": "application/vnd.ms-excel",
+	".ppt": "application/vnd.ms-powerpoint",
+}
+
+// The content type of a file from its first bytes, the extension only tells apart formats sharing a container
+func sniffContentType(head []byte, filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		//ISO media, the brand tells QuickTime from MP4 and HEIF images
+		switch string(head[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "heic", "heix", "mif1":
+			return "image/heic"
+		}
+	case bytes.HasPrefix(head, []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}):
+		if contentType, ok := legacyOfficeTypes[ext]; ok {
+			return contentType
+		}
+		return "application/x-ole-storage"
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		//Matroska, http.DetectContentType only knows the webm flavour
+		if ext == ".mkv" {
+			return "video/x-matroska"
+		}
+		return "video/webm"
+	case bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	}
+
+	contentType := http.DetectContentType(head)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	if contentType == "application/zip" {
+		if officeType, ok := officeTypes[ext]; ok {
+			return officeType
+		}
+	}
+	return contentType
+}
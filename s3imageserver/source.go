@@ -1,8 +1,11 @@
 package s3imageserver
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -11,6 +14,32 @@ type ImageSource interface {
 	GetImage(string) ([]byte, error)
 }
 
+// The context aware interface of sources that stream the image instead of buffering it. The caller closes the reader,
+// cancelling ctx aborts the fetch. Sources may implement it instead of, or along with, ImageSource.
+type StreamingImageSource interface {
+	OpenImage(ctx context.Context, path string) (io.ReadCloser, *ImageMetadata, error)
+}
+
+// Object metadata a source may know about, zero values mean unknown
+type ImageMetadata struct {
+	ETag         string
+	LastModified time.Time
+	Size         int64
+	ContentType  string
+}
+
+var errMetadataUnsupported = errors.New("source cannot look up metadata")
+
+// Optionally implemented by sources that can look up metadata without fetching the image
+type MetadataSource interface {
+	GetMetadata(string) (*ImageMetadata, error)
+}
+
+// Optionally implemented by sources that can return metadata along with the image
+type MetadataImageSource interface {
+	GetImageWithMetadata(string) ([]byte, *ImageMetadata, error)
+}
+
 type SourceMap struct {
 	//a function that takes a struct and returns an interface of type ImageSource
 	sources map[string]*concreteImageSource
@@ -23,7 +52,7 @@ type concreteImageSource struct {
 }
 
 func (sm *SourceMap) AddSource(name string, source interface{}) error {
-	stringErr := "source must be func(type)ImageSource, "
+	stringErr := "source must be func(type)ImageSource or func(type)StreamingImageSource, "
 	sourceVal := reflect.ValueOf(source)
 	sourceTyp := sourceVal.Type()
 
@@ -39,8 +68,9 @@ func (sm *SourceMap) AddSource(name string, source interface{}) error {
 		return errors.New(stringErr + "expecting a function with one return value")
 	}
 
-	if !sourceTyp.Out(0).Implements(reflect.TypeOf((*ImageSource)(nil)).Elem()) {
-		return errors.New(stringErr + "expecting a function with one return value that implements ImageSource")
+	if !sourceTyp.Out(0).Implements(reflect.TypeOf((*ImageSource)(nil)).Elem()) &&
+		!sourceTyp.Out(0).Implements(reflect.TypeOf((*StreamingImageSource)(nil)).Elem()) {
+		return errors.New(stringErr + "expecting a function with one return value that implements ImageSource or StreamingImageSource")
 	}
 
 	if sm.sources == nil {
@@ -69,5 +99,33 @@ func (sm *SourceMap) GetSource(name string, configString json.RawMessage) (Image
 	}
 	retVals := imgSource.val.Call([]reflect.Value{reflect.Indirect(configVal)})
 
-	return retVals[0].Interface().(ImageSource), nil
+	if source, ok := retVals[0].Interface().(ImageSource); ok {
+		return source, nil
+	}
+	return &streamingSource{retVals[0].Interface().(StreamingImageSource)}, nil
+}
+
+// Adapts a source that only streams to ImageSource
+type streamingSource struct {
+	StreamingImageSource
+}
+
+func (s *streamingSource) GetImage(path string) ([]byte, error) {
+	data, _, err := s.GetImageWithMetadata(path)
+	return data, err
+}
+
+func (s *streamingSource) GetImageWithMetadata(path string) ([]byte, *ImageMetadata, error) {
+	return readStream(s.OpenImage(context.Background(), path))
+}
+
+func (s *streamingSource) UsesPreviewOptions() bool {
+	return usesPreviewOptions(s.StreamingImageSource)
+}
+
+func (s *streamingSource) GetMetadata(path string) (*ImageMetadata, error) {
+	if ms, ok := s.StreamingImageSource.(MetadataSource); ok {
+		return ms.GetMetadata(path)
+	}
+	return nil, errMetadataUnsupported
 }
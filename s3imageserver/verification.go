@@ -0,0 +1,68 @@
+package s3imageserver
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultVerificationCookie = "token"
+	tokenParam                = "t"
+)
+
+// Looks for a token in the t query parameter, an Authorization: Bearer header or the configured cookie
+func getToken(r *http.Request, cookieName string) string {
+	if token := r.URL.Query().Get(tokenParam); token != "" {
+		return token
+	}
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	if cookieName == "" {
+		cookieName = defaultVerificationCookie
+	}
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") {
+		return strings.TrimSpace(parts[1])
+	}
+	return ""
+}
+
+// Returns http.StatusOK when the request may proceed, otherwise the status code to reply with
+func verifyRequest(r *http.Request, config HandlerConfig, verify HandleVerification) int {
+	if config.VerificationRequired == nil || !*config.VerificationRequired {
+		return http.StatusOK
+	}
+	if verify == nil {
+		log.Println("verification required for route", config.Route, "but no verification handler was passed to Run")
+		return http.StatusForbidden
+	}
+	token := getToken(r, config.VerificationCookie)
+	if token == "" {
+		return http.StatusUnauthorized
+	}
+	if !verify(token) {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// The URL of a request for the logs, without the token. Headers are left out altogether as they may carry it too.
+func loggableURL(r *http.Request) string {
+	query := r.URL.Query()
+	if _, ok := query[tokenParam]; !ok {
+		return r.URL.String()
+	}
+	query.Set(tokenParam, "REDACTED")
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.String()
+}